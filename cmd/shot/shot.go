@@ -1,41 +1,139 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"text/tabwriter"
+	"time"
 
 	"github.com/dwarvesf/shot/config"
 	"github.com/dwarvesf/shot/dflog"
+	"github.com/dwarvesf/shot/docker"
+	"github.com/dwarvesf/shot/git"
+	"github.com/dwarvesf/shot/notify"
+	"github.com/dwarvesf/shot/progress"
+	"github.com/dwarvesf/shot/rollout"
 	"github.com/dwarvesf/shot/ssh"
 	"github.com/dwarvesf/shot/utils"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
 
 // Usage
-// $ shot setup --file=feature__login.yml  // --> /opt/shot/port
-// $ shot deploy --file=feature__login.yml
-// $ shot down --file=feature__login.yml
+// $ shot setup                         // --> /opt/shot/port
+// $ shot deploy feature__login         // --> .shot/feature__login.yml
+// $ shot down --config=feature__login.yml
 
 var (
 	l = dflog.New()
 
-	app   = kingpin.New("shot", "Automation deployment inside the fortress")
-	debug = app.Flag("debug", "enable debug mode").Default("false").Short('d').Bool()
+	app        = kingpin.New("shot", "Automation deployment inside the fortress")
+	debug      = app.Flag("debug", "enable debug mode, same as --log-level=debug").Default("false").Short('d').Bool()
+	logLevel   = app.Flag("log-level", "Least severe level logged: debug, info, warn, error or fatal").Default("info").Enum("debug", "info", "warn", "warning", "error", "fatal")
+	logFormat  = app.Flag("log-format", "How log entries are written: text, json or logfmt").Default("text").Enum(dflog.Formats...)
+	logFile    = app.Flag("log-file", "Append log entries to this file instead of the standard error").String()
+	configPath = app.Flag("config", "Path to configuration file, defaults to $SHOT_CONFIG, shot.yml or the only file in .shot/ of the repository").Short('c').String()
+	parallel   = app.Flag("parallel", "Maximum number of builds, targets and branches worked on at the same time").Default("4").Int()
+	dryRun     = app.Flag("dry-run", "Print the commands and notifications instead of running or sending them").Bool()
+	noNotify   = app.Flag("no-notify", "Do not send any notification").Bool()
 
-	setup     = app.Command("setup", "Setup all given servers")
-	setupPath = setup.Flag("config", "Path to configuration file").Short('c').String()
+	setup    = app.Command("setup", "Setup all given servers")
+	setupEnv = setup.Arg("environment", "Name of the configuration in .shot/ to use").String()
 
-	deploy     = app.Command("deploy", "Deploy given git branches to targeted servers")
-	deployPath = deploy.Flag("config", "Path to configuration file").Short('c').String()
+	deploy    = app.Command("deploy", "Deploy given git branches to targeted servers")
+	deployEnv = deploy.Arg("environment", "Name of the configuration in .shot/ to use").String()
 
-	down     = app.Command("down", "Put down all the targeted servers")
-	downPath = down.Flag("config", "Path to configuration file").Short('c').String()
+	down    = app.Command("down", "Put down all the targeted servers")
+	downEnv = down.Arg("environment", "Name of the configuration in .shot/ to use").String()
+	downYes = down.Flag("yes", "Do not ask for confirmation when a branch has several containers").Short('y').Bool()
+
+	status    = app.Command("status", "Show the containers of the branches on targeted servers")
+	statusEnv = status.Arg("environment", "Name of the configuration in .shot/ to use").String()
+
+	logs     = app.Command("logs", "Show the output of the containers of the branches on targeted servers")
+	logsEnv  = logs.Arg("environment", "Name of the configuration in .shot/ to use").String()
+	logsTail = logs.Flag("tail", "Number of lines to show from the end of the logs").Default("100").Int()
+
+	gc        = app.Command("gc", "Remove environments of branches deleted from the git remote, or too old")
+	gcEnv     = gc.Arg("environment", "Name of the configuration in .shot/ to use").String()
+	gcTargets = gc.Flag("target", "Only work on the targets with this host, may be a pattern. Repeatable").Short('t').Strings()
+	gcMaxAge  = gc.Flag("max-age", "Also remove environments built longer ago than this, e.g. 336h").Duration()
+	gcRemote  = gc.Flag("remote", "Git remote whose branches are kept").Default("origin").String()
+	gcYes     = gc.Flag("yes", "Do not ask for confirmation").Short('y').Bool()
+
+	prune        = app.Command("prune", "Remove old images of the branches from targeted servers and report the space reclaimed")
+	pruneEnv     = prune.Arg("environment", "Name of the configuration in .shot/ to use").String()
+	pruneTargets = prune.Flag("target", "Only work on the targets with this host, may be a pattern. Repeatable").Short('t').Strings()
+	pruneKeep    = prune.Flag("keep", "Number of most recent images kept per branch, -1 uses project.keep_images").Default("-1").Int()
+
+	validate    = app.Command("validate", "Check the configuration file for mistakes")
+	validateEnv = validate.Arg("environment", "Name of the configuration in .shot/ to use").String()
+
+	deploySel = selectionFlags(deploy)
+	downSel   = selectionFlags(down)
+	statusSel = selectionFlags(status)
+	logsSel   = selectionFlags(logs)
 )
 
+// tracker shows the progress of a deploy, it is nil for other commands
+var tracker *progress.Tracker
+
+// selection holds the flags narrowing down the targets and branches a command works on
+type selection struct {
+	branches *[]string
+	targets  *[]string
+	current  *bool
+}
+
+func selectionFlags(cmd *kingpin.CmdClause) selection {
+	return selection{
+		branches: cmd.Flag("branch", "Branch to use instead of those of the configuration, may be a pattern like feature/*. Repeatable").Short('b').Strings(),
+		targets:  cmd.Flag("target", "Only work on the targets with this host, may be a pattern. Repeatable").Short('t').Strings(),
+		current:  cmd.Flag("current-branch", "Use the branch checked out in the current directory").Bool(),
+	}
+}
+
+// apply narrows the targets and branches of cfg down to the selection
+func (s selection) apply(cfg *config.Config) {
+	branches := *s.branches
+	if *s.current {
+		b, err := git.CurrentBranch()
+		if err != nil {
+			l.Log(dflog.FatalLevel, "Cannot find the current branch", err, nil)
+		}
+		branches = append(branches, b)
+	}
+
+	err := cfg.Select(*s.targets, branches, func(pattern string) ([]string, error) {
+		all, err := git.Branches()
+		if err != nil {
+			return nil, err
+		}
+		var matches []string
+		for _, b := range all {
+			if ok, _ := path.Match(pattern, b); ok {
+				matches = append(matches, b)
+			}
+		}
+		if len(matches) == 0 {
+			l.Log(dflog.WarnLevel, fmt.Sprintf("No branch matches %s", pattern), nil, nil)
+		}
+		return matches, nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
 func init() {
 	app.Version("1.0")
 	app.Author("dev@dwarvesf.com")
@@ -46,16 +144,43 @@ func main() {
 	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
 
 	case setup.FullCommand():
-		setDebugMode()
-		Setup(*setupPath)
+		setLogging()
+		setDryRun()
+		Setup(findConfig(*setupEnv))
 
 	case deploy.FullCommand():
-		setDebugMode()
-		Deploy(*deployPath)
+		setLogging()
+		setDryRun()
+		Deploy(findConfig(*deployEnv), deploySel, *parallel)
 
 	case down.FullCommand():
-		setDebugMode()
-		Down(*downPath)
+		setLogging()
+		setDryRun()
+		Down(findConfig(*downEnv), downSel, *parallel, *downYes)
+
+	case status.FullCommand():
+		setLogging()
+		setDryRun()
+		Status(findConfig(*statusEnv), statusSel, *parallel)
+
+	case logs.FullCommand():
+		setLogging()
+		setDryRun()
+		Logs(findConfig(*logsEnv), logsSel, *logsTail)
+
+	case gc.FullCommand():
+		setLogging()
+		setDryRun()
+		GC(findConfig(*gcEnv), *gcTargets, *gcRemote, *gcMaxAge, *gcYes)
+
+	case prune.FullCommand():
+		setLogging()
+		setDryRun()
+		Prune(findConfig(*pruneEnv), *pruneTargets, *pruneKeep, *parallel)
+
+	case validate.FullCommand():
+		setLogging()
+		Validate(findConfig(*validateEnv))
 
 	default:
 		l.Error("Command not found.")
@@ -64,10 +189,7 @@ func main() {
 
 // Setup creates needed files in target servers
 func Setup(configFile string) {
-	cfg, err := config.Init(configFile)
-	if err != nil {
-		l.Log(dflog.FatalLevel, "Configuration file not found", err, nil)
-	}
+	cfg := loadConfig(configFile)
 
 	for _, target := range cfg.Targets {
 		c := ssh.Credential{
@@ -77,7 +199,7 @@ func Setup(configFile string) {
 		}
 
 		// Silently create log file
-		_, err = ssh.Run(`touch /var/log/shot.log || exit`, c)
+		_, err := ssh.Run(`touch /var/log/shot.log || exit`, c)
 		if err != nil {
 			l.Log(dflog.ErrorLevel, "Cannot run command on server", err, nil)
 			continue
@@ -102,248 +224,1092 @@ func Setup(configFile string) {
 	}
 }
 
+// Validate reports every problem of the configuration file, main exits non-zero when there is any
+func Validate(configFile string) {
+	loadConfig(configFile)
+	fmt.Printf("%s is valid\n", configFile)
+}
+
 // Deploy ...
-func Deploy(configFile string) {
-	cfg, err := config.Init(configFile)
+func Deploy(configFile string, sel selection, parallel int) {
+	cfg := loadConfig(configFile)
+	sel.apply(cfg)
+
+	if err := registryLogin(cfg, nil); err != nil {
+		l.Log(dflog.FatalLevel, "Cannot login to registry", err, nil)
+	}
+
+	// The live table is redrawn on stdout, log entries have to stay clear of it
+	tracker = progress.New(os.Stdout, progress.IsTerminal(os.Stdout) && !utils.DryRun)
+	for _, t := range cfg.Targets {
+		for _, b := range t.Branches {
+			tracker.Add(t.Addr(), b)
+		}
+	}
+	if *logFile == "" {
+		l.SetOutput(tracker.LogWriter(os.Stderr))
+	}
+	tracker.Start()
+
+	// Build every branch once, however many targets it is deployed to
+	builds := buildBranches(cfg, parallel)
+
+	// Targets and their branches share the limit, so at most parallel of them are worked on at once
+	limit := rollout.NewLimit(parallel)
+	err := rollout.Run(cfg.Targets, cfg.Rollout, parallel, func(t config.Target) error {
+		return deployTarget(cfg, t, builds, limit)
+	})
+	tracker.Stop()
+	if *logFile == "" {
+		l.SetOutput(os.Stderr)
+	}
+	// Not deferred: a failed deploy exits on the fatal log below, credentials must go anyway
+	if cfg.RegistryAuth.Logout {
+		registryLogout(cfg, nil)
+	}
 	if err != nil {
-		l.Log(dflog.FatalLevel, "Configuration file not found", err, nil)
+		logRolloutError("Deploy stopped", err)
+		return
+	}
+	l.Log(dflog.InfoLevel, "Done", nil, nil)
+}
+
+// deployTarget runs the images of all branches of the target, it fails if any branch does.
+// Every step taking a connection to the target waits for a slot of limit.
+func deployTarget(cfg *config.Config, t config.Target, builds map[string]*build, limit rollout.Limit) error {
+	lf := dflog.Fields{"target": t.Host}
+	c := ssh.Credential{
+		User: t.User,
+		Host: t.Host,
+		Port: t.Port,
 	}
 
-	var wgT sync.WaitGroup
-	wgT.Add(len(cfg.Targets))
-	for _, e := range cfg.Targets {
-		t := e
-		go func() {
-			defer wgT.Done()
-			lf := dflog.Fields{"target": t.Host}
-			c := ssh.Credential{
-				User: t.User,
-				Host: t.Host,
-				Port: t.Port,
+	// Nothing was deployed to the target, all its branches failed
+	fail := func(step string, err error) error {
+		for _, b := range t.Branches {
+			tracker.Finish(t.Addr(), b, err)
+			sendNotification(cfg, notify.Event{
+				Kind:    notify.DeployFailed,
+				Project: cfg.Project.Name,
+				Branch:  b,
+				Target:  t.Host,
+				Step:    step,
+				Err:     err,
+			}, lf)
+		}
+		return err
+	}
+
+	var port int
+	var step string
+	err := limit.Do(func() (err error) {
+		port, step, err = prepareTarget(cfg, &c, lf)
+		return err
+	})
+	if err != nil {
+		return fail(step, err)
+	}
+	if cfg.RegistryAuth.Logout {
+		defer limit.Do(func() error {
+			registryLogout(cfg, &c)
+			return nil
+		})
+	}
+
+	// Containers of branches deployed before are replaced, they keep their port
+	var list []docker.Container
+	if lErr := limit.Do(func() (err error) {
+		list, err = docker.ListContainers(cfg.Project.Name, c)
+		return err
+	}); lErr != nil {
+		l.Log(dflog.WarnLevel, "Cannot list the containers on server", lErr, lf)
+	}
+	deployed := map[string]int{}
+	for _, ct := range list {
+		deployed[ct.Name] = 0
+		if m := hostPortPattern.FindStringSubmatch(ct.Ports); m != nil {
+			deployed[ct.Name], _ = strconv.Atoi(m[1])
+		}
+	}
+
+	// Reserve a port for each branch up front, they are deployed concurrently
+	ports := map[string]int{}
+	for _, b := range t.Branches {
+		if p := deployed[docker.ContainerName(cfg.Project.Name, b)]; p != 0 {
+			ports[b] = p
+			continue
+		}
+		ports[b] = port
+		port++
+	}
+	err = rollout.Each(t.Branches, limit, func(b string) error {
+		_, replace := deployed[docker.ContainerName(cfg.Project.Name, b)]
+		return deployBranch(cfg, t, c, b, ports[b], replace, builds)
+	})
+
+	// Rewrite port into file
+	limit.Do(func() error {
+		if _, pErr := ssh.Run(fmt.Sprintf(`echo %d > /opt/shot/port || exit`, port), c); pErr != nil {
+			l.Log(dflog.ErrorLevel, "Cannot rewrite port into /opt/shot/port on server", pErr, lf)
+		}
+		return nil
+	})
+
+	return err
+}
+
+// prepareTarget logs the target in to the registry and returns the first port free for the branches,
+// or the step which failed
+func prepareTarget(cfg *config.Config, c *ssh.Credential, lf dflog.Fields) (int, string, error) {
+	port, err := readPort(*c)
+	if err != nil {
+		return 0, "reading the next free port", err
+	}
+
+	if err = registryLogin(cfg, c); err != nil {
+		l.Log(dflog.ErrorLevel, "Cannot login to registry on server", err, lf)
+		return 0, "logging in to the registry", err
+	}
+
+	// The port file is shared by every project on the server. Servers are not
+	// asked in dry-run mode, their port file is assumed to be right.
+	if utils.DryRun {
+		return port, "", nil
+	}
+	checkContainerExists := `docker ps -a -q`
+	res, err := ssh.Run(checkContainerExists, *c)
+	if err != nil {
+		l.Log(dflog.ErrorLevel, "Cannot execute commands", err, lf)
+	}
+	if err == nil && res == "" {
+		// this means no container is running, reset port to 8900
+		_, err := ssh.Run(`echo 8900 > /opt/shot/port || exit`, *c)
+		if err != nil {
+			l.Log(dflog.ErrorLevel, "Cannot write into /opt/shot/port", err, lf)
+		} else {
+			port = 8900
+		}
+	}
+
+	return port, "", nil
+}
+
+// checkRunning fails unless the container is running on the target.
+// Servers are not asked in dry-run mode, the container is assumed running.
+func checkRunning(name string, c ssh.Credential) error {
+	if utils.DryRun {
+		return nil
+	}
+	res, err := ssh.Run(fmt.Sprintf("docker inspect -f '{{.State.Running}}' %s", name), c)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(res) != "true" {
+		return errors.New("container is not running")
+	}
+	return nil
+}
+
+// readPort returns the next free port recorded on the target. Servers are not
+// touched in dry-run mode, the port they start with is assumed.
+func readPort(c ssh.Credential) (int, error) {
+	if utils.DryRun {
+		return 8900, nil
+	}
+
+	// Check if available port file is existed or not
+	res, err := ssh.Run(`if test -f "/opt/shot/port"; then echo "Found";fi`, c)
+	if err != nil {
+		l.Log(dflog.ErrorLevel, "Cannot run command on server", err, nil)
+		return 0, err
+	}
+	if strings.TrimSpace(res) != "Found" {
+		err = errors.New("cannot read port from file /opt/shot/port on server")
+		l.Log(dflog.ErrorLevel, "Cannot read port from file /opt/shot/port on server", nil, nil)
+		return 0, err
+	}
+
+	availablePort, err := ssh.Run("cat /opt/shot/port", c)
+	if err != nil {
+		l.Log(dflog.ErrorLevel, "Cannot run command on server", err, nil)
+		return 0, err
+	}
+	port, err := strconv.Atoi(strings.TrimSpace(availablePort))
+	if err != nil {
+		l.Log(dflog.ErrorLevel, "Cannot read port from server", err, nil)
+		return 0, err
+	}
+
+	return port, nil
+}
+
+// deployBranch gets the image of the branch onto the target, runs it on given port and notifies about it.
+// The container the branch already has on the target is replaced when replace is set.
+func deployBranch(cfg *config.Config, t config.Target, c ssh.Credential, b string, port int, replace bool, builds map[string]*build) (err error) {
+	lf := dflog.Fields{"target": t.Host, "branch": b}
+	e := notify.Event{
+		Kind:    notify.DeployStarted,
+		Project: cfg.Project.Name,
+		Branch:  b,
+		Target:  t.Host,
+		Port:    port,
+		URL:     fmt.Sprintf("http://%s:%d", t.Host, port),
+	}
+	sendNotification(cfg, e, lf)
+	start := time.Now()
+	step := "resolving the commit"
+	defer func() {
+		tracker.Finish(t.Addr(), b, err)
+		if err != nil {
+			e.Kind, e.Step, e.Err, e.Duration = notify.DeployFailed, step, err, time.Since(start)
+			// The container may have started and crashed, its output tells why
+			if step == "starting the container" || step == "checking the container" {
+				e.Logs, _ = ssh.Run(fmt.Sprintf("docker logs --tail 30 %s 2>&1", docker.ContainerName(cfg.Project.Name, b)), c)
 			}
+			sendNotification(cfg, e, lf)
+		}
+	}()
 
-			// Check if available port file is existed or not
-			res, err := ssh.Run(`if test -f "/opt/shot/port"; then echo "Found";fi`, c)
-			if err != nil {
-				l.Log(dflog.ErrorLevel, "Cannot run command on server", err, nil)
-				return
+	mode := cfg.BuildModeOf(t)
+	lf["build_mode"] = mode
+	if utils.DryRun {
+		utils.PrintPlan(t.Host, fmt.Sprintf("# deploy %s on port %d (%s build)", b, port, mode))
+	}
+
+	// Images built locally are shared by every target, remote builds
+	// need the commit uploaded to each of them
+	var image docker.Image
+	if mode == config.BuildModeRemote {
+		tracker.Step(t.Addr(), b, progress.Checkout)
+		var sha string
+		sha, err = git.ResolveCommit(b)
+		if err != nil {
+			l.Log(dflog.ErrorLevel, "Cannot resolve branch", err, lf)
+			return err
+		}
+		image = newImage(cfg, b, sha)
+		lf["commit"] = sha
+		e.SHA = sha
+		e.Author, _ = git.Author(sha)
+		l.Log(dflog.InfoLevel, fmt.Sprintf("Building %s at %s on server", b, git.Short(sha)), nil, lf)
+		step = "building the image on the server"
+		tracker.Step(t.Addr(), b, progress.Build)
+		err = buildRemote(image, cfg.Project.Build, c)
+	} else {
+		bd := builds[b]
+		step = "building the image"
+		if bd.err != nil {
+			l.Log(dflog.ErrorLevel, "Cannot deploy branch which failed to build", bd.err, lf)
+			return bd.err
+		}
+		image = bd.image
+		lf["commit"] = image.SHA
+		e.SHA = image.SHA
+		e.Author, _ = git.Author(image.SHA)
+		if mode == config.BuildModeTransfer {
+			step = "transferring the image"
+			tracker.Step(t.Addr(), b, progress.Push)
+			err = transferImage(image, c)
+		}
+	}
+	if err != nil {
+		l.Log(dflog.ErrorLevel, "Cannot continue deploy due to unexpected error", err, lf)
+		return err
+	}
+	imageName := image.Ref()
+	e.Image = imageName
+
+	// Pull and run containers, images built or loaded on the target are already there
+	dockerPullCmd := fmt.Sprintf("docker pull %s", imageName)
+	dockerRmCmd := fmt.Sprintf("docker rm -f %s", docker.ContainerName(cfg.Project.Name, b))
+	dockerRunCmd := fmt.Sprintf("docker run -d -p %d:%d --name %s %s %s", port, cfg.Project.Port, docker.ContainerName(cfg.Project.Name, b), utils.ShellJoin(docker.LabelArgs(image.Labels())), imageName)
+	var cmds, steps []string
+	var stages []progress.Step
+	if mode == config.BuildModeLocal {
+		cmds = append(cmds, dockerPullCmd)
+		steps = append(steps, "pulling the image")
+		stages = append(stages, progress.Pull)
+	}
+	// The previous container goes only once the new image is there, it holds the name and port
+	if replace {
+		cmds = append(cmds, dockerRmCmd)
+		steps = append(steps, "removing the previous container")
+		stages = append(stages, progress.Run)
+	}
+	cmds = append(cmds, dockerRunCmd)
+	steps = append(steps, "starting the container")
+	stages = append(stages, progress.Run)
+	var res string
+	var cErr error
+	for i, cmd := range cmds {
+		step = steps[i]
+		tracker.Step(t.Addr(), b, stages[i])
+		res, cErr = ssh.Run(cmd, c)
+		if cErr != nil {
+			l.Log(dflog.ErrorLevel, "Cannot run command on server", cErr, lf)
+			break
+		}
+		if strings.Contains(res, "docker: Error response from daemon") {
+			cErr = errors.New(res)
+			l.Log(dflog.ErrorLevel, "Cannot run command on server", cErr, lf)
+			break
+		}
+	}
+	if cErr != nil {
+		l.Log(dflog.ErrorLevel, "Cannot use 'docker run' due to unexpected error", cErr, lf)
+		return cErr
+	}
+
+	// A container which exits right away was started fine but is not deployed
+	step = "checking the container"
+	tracker.Step(t.Addr(), b, progress.Health)
+	if err = checkRunning(docker.ContainerName(cfg.Project.Name, b), c); err != nil {
+		l.Log(dflog.ErrorLevel, "Container is not running", err, lf)
+		return err
+	}
+	if _, err = docker.PruneImages(cfg.Project.Name, c, b, cfg.Project.KeepImages); err != nil {
+		l.Log(dflog.WarnLevel, "Cannot remove old images", err, lf)
+	}
+
+	tracker.Step(t.Addr(), b, progress.Notify)
+	e.Kind, e.Duration = notify.DeploySucceeded, time.Since(start)
+	sendNotification(cfg, e, lf)
+
+	return nil
+}
+
+// Down removes the containers of the branches from the targets
+func Down(configFile string, sel selection, parallel int, yes bool) {
+	cfg := loadConfig(configFile)
+	sel.apply(cfg)
+
+	// Targets and their branches share the limit, so at most parallel of them are worked on at once
+	limit := rollout.NewLimit(parallel)
+	err := rollout.Run(cfg.Targets, cfg.Rollout, parallel, func(t config.Target) error {
+		c := ssh.Credential{
+			User: t.User,
+			Host: t.Host,
+			Port: t.Port,
+		}
+		var list []docker.Container
+		err := limit.Do(func() (err error) {
+			list, err = docker.ListContainers(cfg.Project.Name, c)
+			return err
+		})
+		if err != nil {
+			l.Log(dflog.ErrorLevel, "Cannot run command on server", err, dflog.Fields{"target": t.Host})
+			return err
+		}
+
+		err = rollout.Each(t.Branches, limit, func(b string) error {
+			return downBranch(cfg, t, c, b, list, yes)
+		})
+		limit.Do(func() error {
+			if pErr := releasePorts(c); pErr != nil {
+				l.Log(dflog.WarnLevel, "Cannot free ports on server", pErr, dflog.Fields{"target": t.Host})
 			}
-			if strings.TrimSpace(res) != "Found" {
-				l.Log(dflog.ErrorLevel, "Cannot read port from file /opt/shot/port on server", nil, nil)
-				return
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		logRolloutError("Down stopped", err)
+		return
+	}
+	l.Log(dflog.InfoLevel, "Done", nil, nil)
+}
+
+// downBranch removes the containers of the branch among those deployed on the target,
+// found by exact name or by label, and notifies about it
+func downBranch(cfg *config.Config, t config.Target, c ssh.Credential, b string, deployed []docker.Container, yes bool) error {
+	lf := dflog.Fields{"target": t.Host, "branch": b}
+	if utils.DryRun {
+		utils.PrintPlan(t.Host, "# down "+b)
+	}
+
+	name := docker.ContainerName(cfg.Project.Name, b)
+	var names []string
+	var sha string
+	for _, ct := range deployed {
+		if ct.Name == name || ct.Branch == b {
+			names = append(names, ct.Name)
+			if ct.Name == name || sha == "" {
+				sha = ct.SHA
 			}
+		}
+	}
+	// Servers are not asked in dry-run mode, the branch is assumed deployed
+	if utils.DryRun && len(names) == 0 {
+		names = []string{name}
+	}
 
-			availablePort, err := ssh.Run("cat /opt/shot/port", c)
-			if err != nil {
-				l.Log(dflog.ErrorLevel, "Cannot run command on server", err, nil)
-				return
+	if len(names) == 0 {
+		l.Log(dflog.InfoLevel, fmt.Sprintf("%s is not deployed on %s", b, t.Host), nil, lf)
+		return nil
+	}
+	if len(names) > 1 && !yes && !utils.DryRun &&
+		!confirm(fmt.Sprintf("%s on %s has %d containers: %s. Remove them all?", b, t.Host, len(names), strings.Join(names, ", "))) {
+		l.Log(dflog.InfoLevel, "Skipped", nil, lf)
+		return nil
+	}
+
+	if _, err := ssh.Run("docker rm -f "+utils.ShellJoin(names), c); err != nil {
+		l.Log(dflog.ErrorLevel, "Cannot execute commands", err, lf)
+		return err
+	}
+	if _, err := docker.PruneImages(cfg.Project.Name, c, b, cfg.Project.KeepImages); err != nil {
+		l.Log(dflog.WarnLevel, "Cannot remove old images", err, lf)
+	}
+
+	sendNotification(cfg, notify.Event{Kind: notify.Down, Project: cfg.Project.Name, Branch: b, SHA: sha, Target: t.Host}, lf)
+
+	return nil
+}
+
+// portMu serializes changes to the port file of targets
+var portMu sync.Mutex
+
+// hostPortPattern matches the host port of a published port, e.g. 0.0.0.0:8901->3000/tcp
+var hostPortPattern = regexp.MustCompile(`:(\d+)->`)
+
+// releasePorts moves the next port given out on the target back to just after the
+// highest one still published, so that the ports of removed containers are reused
+func releasePorts(c ssh.Credential) error {
+	portMu.Lock()
+	defer portMu.Unlock()
+
+	res, err := ssh.Run(`docker ps -a --format '{{.Ports}}'`, c)
+	if err != nil {
+		return err
+	}
+	next := 8900
+	for _, m := range hostPortPattern.FindAllStringSubmatch(res, -1) {
+		if p, _ := strconv.Atoi(m[1]); p >= next {
+			next = p + 1
+		}
+	}
+
+	current, err := readPort(c)
+	if err != nil {
+		return err
+	}
+	// Ports handed out to deploys which failed are not known to docker, never go forward
+	if next >= current {
+		return nil
+	}
+	_, err = ssh.Run(fmt.Sprintf(`echo %d > /opt/shot/port || exit`, next), c)
+	return err
+}
+
+// Status prints the container of every branch on every target
+func Status(configFile string, sel selection, parallel int) {
+	cfg := loadConfig(configFile)
+	sel.apply(cfg)
+
+	// Ask all targets at once but print in the order of the configuration
+	rows := make([][]string, len(cfg.Targets))
+	idx := map[string]int{}
+	for i, t := range cfg.Targets {
+		idx[fmt.Sprintf("%s:%d", t.Host, t.Port)] = i
+	}
+	rollout.Run(cfg.Targets, config.Rollout{}, parallel, func(t config.Target) error {
+		rows[idx[fmt.Sprintf("%s:%d", t.Host, t.Port)]] = targetStatus(cfg, t)
+		return nil
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tBRANCH\tCONTAINER\tCOMMIT\tSTATUS\tPORTS")
+	for _, r := range rows {
+		for _, line := range r {
+			fmt.Fprintln(w, line)
+		}
+	}
+	w.Flush()
+}
+
+// targetStatus returns one status line per branch of the target
+func targetStatus(cfg *config.Config, t config.Target) []string {
+	c := ssh.Credential{
+		User: t.User,
+		Host: t.Host,
+		Port: t.Port,
+	}
+
+	list, err := docker.ListContainers(cfg.Project.Name, c)
+	if err != nil {
+		l.Log(dflog.ErrorLevel, "Cannot run command on server", err, dflog.Fields{"target": t.Host})
+		return []string{fmt.Sprintf("%s\t-\t-\t-\tunreachable\t-", t.Host)}
+	}
+	containers := map[string]docker.Container{}
+	for _, ct := range list {
+		containers[ct.Name] = ct
+	}
+
+	var lines []string
+	for _, b := range t.Branches {
+		name := docker.ContainerName(cfg.Project.Name, b)
+		ct, ok := containers[name]
+		if !ok {
+			lines = append(lines, fmt.Sprintf("%s\t%s\t-\t-\tnot deployed\t-", t.Host, b))
+			continue
+		}
+		sha := git.Short(ct.SHA)
+		if sha == "" {
+			sha = "-"
+		}
+		lines = append(lines, fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s", t.Host, b, name, sha, ct.Status, ct.Ports))
+	}
+	return lines
+}
+
+// GC removes the environments whose branch is gone from the git remote or which are
+// older than maxAge, when it is not zero, together with their images
+func GC(configFile string, hosts []string, remote string, maxAge time.Duration, yes bool) {
+	cfg := loadConfig(configFile)
+	err := cfg.Select(hosts, nil, func(string) ([]string, error) { return nil, nil })
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	heads, err := git.RemoteHeads(remote)
+	if err != nil {
+		l.Log(dflog.FatalLevel, fmt.Sprintf("Cannot list the branches of %s", remote), err, nil)
+	}
+	// Never take everything down because of a remote answering with nothing
+	if len(heads) == 0 {
+		l.Log(dflog.FatalLevel, fmt.Sprintf("Remote %s has no branch, refusing to collect", remote), nil, nil)
+	}
+	alive := map[string]bool{}
+	for _, b := range heads {
+		alive[b] = true
+		alive[docker.ContainerName(cfg.Project.Name, b)] = true
+	}
+
+	type stale struct {
+		target    config.Target
+		container docker.Container
+		reason    string
+		// keep is how many images of the branch stay for rollback
+		keep int
+	}
+	var found []stale
+	// Targets which cannot be listed fail the collection, whatever is found on the others
+	unlisted := 0
+	for _, t := range cfg.Targets {
+		c := ssh.Credential{
+			User: t.User,
+			Host: t.Host,
+			Port: t.Port,
+		}
+		list, err := docker.ListContainers(cfg.Project.Name, c)
+		if err != nil {
+			l.Log(dflog.ErrorLevel, "Cannot run command on server", err, dflog.Fields{"target": t.Host})
+			unlisted++
+			continue
+		}
+		for _, ct := range list {
+			// Containers shot did not label are matched by name
+			switch {
+			case ct.Branch != "" && !alive[ct.Branch], ct.Branch == "" && !alive[ct.Name]:
+				found = append(found, stale{t, ct, fmt.Sprintf("branch deleted from %s", remote), 0})
+			case maxAge != 0 && !ct.Built.IsZero() && time.Since(ct.Built) > maxAge:
+				found = append(found, stale{t, ct, fmt.Sprintf("built %s ago", time.Since(ct.Built).Round(time.Hour)), cfg.Project.KeepImages})
 			}
-			port, err := strconv.Atoi(strings.TrimSpace(availablePort))
-			if err != nil {
-				l.Log(dflog.ErrorLevel, "Cannot read port from server", err, nil)
-				return
+		}
+	}
+
+	if len(found) == 0 {
+		if unlisted > 0 {
+			l.Log(dflog.FatalLevel, fmt.Sprintf("Cannot list the environments of %d of %d target(s)", unlisted, len(cfg.Targets)), nil, nil)
+		}
+		fmt.Println("Nothing to collect")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tCONTAINER\tIMAGE\tREASON")
+	for _, s := range found {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.target.Host, s.container.Name, s.container.Image, s.reason)
+	}
+	w.Flush()
+
+	if !yes && !utils.DryRun && !confirm(fmt.Sprintf("Remove these %d environment(s)?", len(found))) {
+		return
+	}
+
+	failed := 0
+	for _, s := range found {
+		lf := dflog.Fields{"target": s.target.Host, "container": s.container.Name}
+		c := ssh.Credential{
+			User: s.target.User,
+			Host: s.target.Host,
+			Port: s.target.Port,
+		}
+		// Environments which fail to be removed are not announced as down
+		if _, err := ssh.Run(fmt.Sprintf("docker rm -f %s", s.container.Name), c); err != nil {
+			l.Log(dflog.ErrorLevel, "Cannot remove container", err, lf)
+			failed++
+			continue
+		}
+		if s.container.Branch != "" {
+			if _, err := docker.PruneImages(cfg.Project.Name, c, s.container.Branch, s.keep); err != nil {
+				l.Log(dflog.WarnLevel, "Cannot remove images", err, lf)
 			}
+		} else if _, err := ssh.Run(fmt.Sprintf("docker rmi %s", s.container.Image), c); err != nil {
+			// The image may still be used by another environment, then it stays
+			l.Log(dflog.WarnLevel, "Cannot remove image", err, lf)
+		}
 
-			checkContainerExists := fmt.Sprintf(`docker ps -a --filter="name=%s__%s" -q`, cfg.Project.Name, cfg.Registry)
-			res, err = ssh.Run(checkContainerExists, c)
-			if err != nil {
-				l.Log(dflog.ErrorLevel, "Cannot execute commands", err, lf)
+		branch := s.container.Branch
+		if branch == "" {
+			branch = s.container.Name
+		}
+		sendNotification(cfg, notify.Event{
+			Kind:    notify.Down,
+			Project: cfg.Project.Name,
+			Branch:  branch,
+			SHA:     s.container.SHA,
+			Target:  s.target.Host,
+			Reason:  s.reason,
+		}, lf)
+	}
+	if failed > 0 || unlisted > 0 {
+		l.Log(dflog.FatalLevel, fmt.Sprintf("Cannot remove %d of %d environment(s), cannot list %d of %d target(s)", failed, len(found), unlisted, len(cfg.Targets)), nil, nil)
+	}
+	l.Log(dflog.InfoLevel, "Done", nil, nil)
+}
+
+// humanSize formats a number of bytes the way docker does, e.g. 1.2GB
+func humanSize(n int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	v := float64(n)
+	i := 0
+	for v >= 1000 && i < len(units)-1 {
+		v /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.3g%s", v, units[i])
+}
+
+// Prune removes the old images of every branch from the targets, keeping the keep most
+// recent of each (project.keep_images when keep < 0), and prints the space reclaimed
+func Prune(configFile string, hosts []string, keep int, parallel int) {
+	cfg := loadConfig(configFile)
+	err := cfg.Select(hosts, nil, func(string) ([]string, error) { return nil, nil })
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if keep < 0 {
+		keep = cfg.Project.KeepImages
+	}
+
+	rows := make([]string, len(cfg.Targets))
+	idx := map[string]int{}
+	for i, t := range cfg.Targets {
+		idx[fmt.Sprintf("%s:%d", t.Host, t.Port)] = i
+	}
+	rollout.Run(cfg.Targets, config.Rollout{}, parallel, func(t config.Target) error {
+		i := idx[fmt.Sprintf("%s:%d", t.Host, t.Port)]
+		rows[i] = fmt.Sprintf("%s\t-\tfailed", t.Host)
+		lf := dflog.Fields{"target": t.Host}
+		c := ssh.Credential{
+			User: t.User,
+			Host: t.Host,
+			Port: t.Port,
+		}
+
+		before, fErr := docker.FreeSpace(c)
+		// Images which could not be removed are reported but do not fail the whole target
+		removed, err := docker.PruneImages(cfg.Project.Name, c, "", keep)
+		if err != nil {
+			l.Log(dflog.ErrorLevel, "Cannot remove images", err, lf)
+			if removed == nil {
+				return nil
 			}
-			if res == "" {
-				// this means no container is running, reset port to 8900
-				_, err := ssh.Run(`echo 8900 > /opt/shot/port || exit`, c)
-				if err != nil {
-					l.Log(dflog.ErrorLevel, "Cannot write into /opt/shot/port", err, lf)
-				} else {
-					port = 8900
-				}
+		}
+		// Layers left behind by builds on the target
+		if _, err = ssh.Run(fmt.Sprintf("docker image prune -f --filter label=%s", utils.ShellQuote(docker.LabelProject+"="+cfg.Project.Name)), c); err != nil {
+			l.Log(dflog.WarnLevel, "Cannot remove dangling images", err, lf)
+		}
+		after, aErr := docker.FreeSpace(c)
+
+		// Layers are shared between images, the disk tells what was really freed
+		reclaimed := "unknown"
+		if fErr == nil && aErr == nil {
+			reclaimed = humanSize(after - before)
+			if after < before {
+				reclaimed = humanSize(0)
 			}
+		}
+		rows[i] = fmt.Sprintf("%s\t%d\t%s", t.Host, len(removed), reclaimed)
+		return nil
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tIMAGES REMOVED\tRECLAIMED")
+	for _, r := range rows {
+		fmt.Fprintln(w, r)
+	}
+	w.Flush()
+}
+
+// confirmMu keeps questions asked from concurrent goroutines apart
+var confirmMu sync.Mutex
+
+// confirm asks the question on the terminal and reports whether it was answered yes
+func confirm(question string) bool {
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
 
-			var wgB sync.WaitGroup
-			wgB.Add(len(t.Branches))
-			for _, v := range t.Branches {
-				b := v
-				go func() {
-					defer wgB.Done()
-					lf := dflog.Fields{"target": t.Host, "branch": b}
-					gco := fmt.Sprintf("git checkout %s", b)
-					imageName := fmt.Sprintf("%s/%s:%s", cfg.Registry, cfg.Project.Name, strings.Replace(b, "/", "-", -1))
-					dockerBuildCmd := fmt.Sprintf("docker build -t %s .", imageName)
-					dockerPushCmd := fmt.Sprintf("docker push %s", imageName)
-
-					// Dockerize all containers
-					cmds := []string{gco, dockerBuildCmd, dockerPushCmd}
-					var err error
-					for _, cmd := range cmds {
-						_, err = utils.ExecCmd(cmd)
-						if err != nil {
-							l.Log(dflog.ErrorLevel, fmt.Sprintf("Cannot run command: %s", cmd), err, lf)
-							break
-						}
-					}
-					if err != nil {
-						l.Log(dflog.ErrorLevel, "Cannot continue deploy due to unexpected error", err, lf)
-						return
-					}
-
-					// Pull and run containers
-					dockerPullCmd := fmt.Sprintf("docker pull %s", imageName)
-					dockerRunCmd := fmt.Sprintf("docker run -d -p %d:%d --name %s %s", port, cfg.Project.Port, fmt.Sprintf("%s__%s", strings.Replace(cfg.Project.Name, "/", "-", -1), strings.Replace(b, "/", "-", -1)), imageName)
-					cmds = []string{dockerPullCmd, dockerRunCmd}
-					var cErr error
-					for _, cmd := range cmds {
-						res, cErr = ssh.Run(cmd, ssh.Credential{
-							User: t.User,
-							Host: t.Host,
-							Port: t.Port,
-						})
-						if cErr != nil {
-							l.Log(dflog.ErrorLevel, "Cannot run command on server", cErr, lf)
-							break
-						}
-						if strings.Contains(res, "docker: Error response from daemon") {
-							cErr = errors.New(res)
-							l.Log(dflog.ErrorLevel, "Cannot run command on server", cErr, lf)
-							break
-						}
-					}
-					if cErr != nil {
-						l.Log(dflog.ErrorLevel, "Cannot use 'docker run' due to unexpected error", cErr, lf)
-						return
-					}
-
-					// Send notification
-					message := fmt.Sprintf("Deployed (%s:%s) to server %s:%d", cfg.Project.Name, b, t.Host, port)
-					if cfg.Notification.Email.Enable {
-						var wgM sync.WaitGroup
-						wgM.Add(len(cfg.Notification.Email.Recipients))
-						for _, v := range cfg.Notification.Email.Recipients {
-							r := v
-							go func() {
-								defer wgM.Done()
-								l.Info("Sending mail to ", r)
-								err := utils.SendMail(r, fmt.Sprintf("Deployed %s to server with PR %s", cfg.Project.Name, b), message, cfg)
-								if err != nil {
-									l.Log(dflog.ErrorLevel, fmt.Sprintf("Cannot send mail to %s", r), err, lf)
-								}
-							}()
-						}
-						wgM.Wait()
-					}
-
-					// Post to Slack
-					if cfg.Notification.Slack.Enable {
-						var wgS sync.WaitGroup
-						wgS.Add(len(cfg.Notification.Slack.Channels))
-						for _, v := range cfg.Notification.Slack.Channels {
-							c := v
-							go func() {
-								defer wgS.Done()
-								l.Info("Posting to Slack channel ", c)
-								err := utils.PostToSlack(c, message)
-								if err != nil {
-									l.Log(dflog.ErrorLevel, fmt.Sprintf("Cannot post to channel %s", c), err, lf)
-								}
-							}()
-						}
-						wgS.Wait()
-					}
-
-					// Rewrite port into file
-					port = port + 1
-					_, err = ssh.Run(fmt.Sprintf(`echo %d > /opt/shot/port || exit`, port), c)
-					if err != nil {
-						l.Log(dflog.ErrorLevel, "Cannot rewrite port into /opt/shot/port on server", err, lf)
-					}
-				}()
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// Logs prints the last lines of output of the container of every branch on every target
+func Logs(configFile string, sel selection, tail int) {
+	cfg := loadConfig(configFile)
+	sel.apply(cfg)
+
+	for _, t := range cfg.Targets {
+		c := ssh.Credential{
+			User: t.User,
+			Host: t.Host,
+			Port: t.Port,
+		}
+		for _, b := range t.Branches {
+			cmd := fmt.Sprintf("docker logs --tail %d %s", tail, docker.ContainerName(cfg.Project.Name, b))
+			res, err := ssh.Run(cmd, c)
+			if err != nil {
+				l.Log(dflog.ErrorLevel, "Cannot run command on server", err, dflog.Fields{"target": t.Host, "branch": b})
+				continue
 			}
-			wgB.Wait()
-		}()
+			fmt.Printf("==> %s %s <==\n%s\n", t.Host, b, strings.TrimRight(res, "\n"))
+		}
 	}
-	wgT.Wait()
-	l.Log(dflog.InfoLevel, "Done", nil, nil)
 }
 
-// Down ...
-func Down(configFile string) {
-	cfg, err := config.Init(configFile)
-	if err != nil {
-		l.Log(dflog.FatalLevel, "Configuration file not found", err, nil)
+// sendNotification tells every channel enabled in the configuration about the event
+func sendNotification(cfg *config.Config, e notify.Event, lf dflog.Fields) {
+	if *noNotify {
+		return
+	}
+	err := notify.New(cfg).Notify(e)
+	if nErr, ok := err.(*notify.Error); ok {
+		for name, err := range nErr.Failed {
+			l.Log(dflog.ErrorLevel, fmt.Sprintf("Cannot notify %s", name), err, lf)
+		}
+	}
+}
+
+// logRolloutError reports which targets failed and which were skipped, then exits
+func logRolloutError(msg string, err error) {
+	lf := dflog.Fields{}
+	if rErr, ok := err.(*rollout.Error); ok {
+		for addr, e := range rErr.Failed {
+			lf[addr] = e.Error()
+		}
+		if len(rErr.Skipped) != 0 {
+			lf["skipped"] = strings.Join(rErr.Skipped, ",")
+		}
+	}
+	l.Log(dflog.FatalLevel, msg, err, lf)
+}
+
+// build is the outcome of building the image of a branch
+type build struct {
+	image docker.Image
+	push  bool
+	err   error
+}
+
+// buildBranches builds the image of every branch deployed in local or transfer mode
+// exactly once, at most parallel at a time (no limit when parallel < 1). Images are pushed when any target pulls them.
+func buildBranches(cfg *config.Config, parallel int) map[string]*build {
+	builds := map[string]*build{}
+	var branches []string
+	// targets waiting on each build, their rows show its progress
+	addrs := map[string][]string{}
+	for _, t := range cfg.Targets {
+		mode := cfg.BuildModeOf(t)
+		if mode == config.BuildModeRemote {
+			continue
+		}
+		for _, b := range t.Branches {
+			bd, ok := builds[b]
+			if !ok {
+				bd = &build{}
+				builds[b] = bd
+				branches = append(branches, b)
+			}
+			addrs[b] = append(addrs[b], t.Addr())
+			if mode == config.BuildModeLocal {
+				bd.push = true
+			}
+		}
 	}
 
-	var wgT sync.WaitGroup
-	wgT.Add(len(cfg.Targets))
-	for _, e := range cfg.Targets {
-		t := e
+	if parallel < 1 {
+		parallel = len(branches) + 1
+	}
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	wg.Add(len(branches))
+	for _, v := range branches {
+		b := v
+		bd := builds[b]
 		go func() {
-			defer wgT.Done()
-			var wgB sync.WaitGroup
-			wgB.Add(len(t.Branches))
-			for _, v := range t.Branches {
-				b := v
-				go func() {
-					defer wgB.Done()
-					lf := dflog.Fields{"target": t.Host, "branch": b}
-					// Remove related docker containers
-					containerName := fmt.Sprintf("%s__%s", strings.Replace(cfg.Project.Name, "/", "-", -1), strings.Replace(b, "/", "-", -1))
-					dockerRemoveCmd := fmt.Sprintf(`docker rm -f $(docker ps -a --filter="name=%s" -q)`, containerName)
-					_, err := ssh.Run(dockerRemoveCmd, ssh.Credential{
-						User: t.User,
-						Host: t.Host,
-						Port: t.Port,
-					})
-					if err != nil {
-						l.Log(dflog.ErrorLevel, "Cannot execute commands", err, lf)
-					}
-
-					// Send notification
-					// Send mail
-					message := fmt.Sprintf("Shutdown (%s:%s) from server %s", cfg.Project.Name, b, t.Host)
-					if cfg.Notification.Email.Enable {
-						var wgM sync.WaitGroup
-						wgM.Add(len(cfg.Notification.Email.Recipients))
-						for _, v := range cfg.Notification.Email.Recipients {
-							r := v
-							go func() {
-								defer wgM.Done()
-								l.Info("Sending mail to ", r)
-								err := utils.SendMail(r, fmt.Sprintf("Shutdown (%s:%s) from server %s", cfg.Project.Name, b, t.Host), message, cfg)
-								if err != nil {
-									l.Log(dflog.ErrorLevel, fmt.Sprintf("Cannot send mail to %s", r), err, lf)
-								}
-							}()
-						}
-						wgM.Wait()
-					}
-
-					// Post to Slack
-					if cfg.Notification.Slack.Enable {
-						var wgS sync.WaitGroup
-						wgS.Add(len(cfg.Notification.Slack.Channels))
-						for _, v := range cfg.Notification.Slack.Channels {
-							c := v
-							go func() {
-								defer wgS.Done()
-								l.Info("Posting to Slack channel ", c)
-								err := utils.PostToSlack(c, message)
-								if err != nil {
-									l.Log(dflog.ErrorLevel, fmt.Sprintf("Cannot post to channel %s", c), err, lf)
-								}
-							}()
-						}
-						wgS.Wait()
-					}
-				}()
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			bd.image, bd.err = buildBranch(cfg, b, bd.push, func(s progress.Step) {
+				for _, a := range addrs[b] {
+					tracker.Step(a, b, s)
+				}
+			})
+			if bd.err != nil {
+				l.Log(dflog.ErrorLevel, "Cannot build branch", bd.err, dflog.Fields{"branch": b})
 			}
-			wgB.Wait()
 		}()
 	}
-	wgT.Wait()
-	l.Log(dflog.InfoLevel, "Done", nil, nil)
+	wg.Wait()
+
+	return builds
 }
 
-func setDebugMode() {
+// buildBranch checks out the branch into its own worktree, so parallel builds never share,
+// or touch, the current working directory, and builds its image there. step is told what is being done.
+func buildBranch(cfg *config.Config, branch string, push bool, step func(progress.Step)) (docker.Image, error) {
+	if utils.DryRun {
+		utils.PrintPlan("local", "# build "+branch)
+	}
+	step(progress.Checkout)
+	wt, err := git.NewWorktree(branch)
+	if err != nil {
+		return docker.Image{}, fmt.Errorf("cannot checkout branch: %v", err)
+	}
+	defer func() {
+		if err := wt.Remove(); err != nil {
+			l.Log(dflog.WarnLevel, fmt.Sprintf("Cannot remove worktree %s", wt.Dir), err, dflog.Fields{"branch": branch})
+		}
+	}()
+
+	l.Log(dflog.InfoLevel, fmt.Sprintf("Building %s at %s", branch, wt.ShortSHA()), nil, dflog.Fields{"branch": branch, "commit": wt.SHA})
+	image := newImage(cfg, branch, wt.SHA)
+	return image, buildLocal(image, cfg.Project.Build, wt.Dir, push, step)
+}
+
+// newImage describes the image of the branch at given commit. Every build is tagged with its
+// commit so it can be told apart and rolled back, the branch tag moves along to the latest build.
+func newImage(cfg *config.Config, branch, sha string) docker.Image {
+	return docker.Image{
+		Registry:  cfg.Registry,
+		Project:   cfg.Project.Name,
+		Repo:      git.RemoteURL(),
+		Branch:    branch,
+		SHA:       sha,
+		Built:     time.Now(),
+		Timestamp: cfg.Project.TagTimestamp,
+	}
+}
+
+// buildLocal builds the image from the checkout in dir and optionally pushes it to the registry
+func buildLocal(image docker.Image, b config.Build, dir string, push bool, step func(progress.Step)) error {
+	build, err := docker.BuildArgs(image, b, dir)
+	if err != nil {
+		return fmt.Errorf("invalid build configuration: %v", err)
+	}
+
+	cmds := [][]string{build}
+	steps := []progress.Step{progress.Build}
+	if push {
+		cmds = append(cmds, []string{"docker", "push", image.Ref()}, []string{"docker", "push", image.BranchRef()})
+		steps = append(steps, progress.Push, progress.Push)
+	}
+	for i, cmd := range cmds {
+		step(steps[i])
+		// Dry runs print the command already
+		if !utils.DryRun {
+			l.Info(utils.ShellJoin(cmd))
+		}
+		if _, err := utils.Exec(cmd[0], cmd[1:]...); err != nil {
+			return fmt.Errorf("cannot run command %s: %v", utils.ShellJoin(cmd), err)
+		}
+	}
+
+	return nil
+}
+
+// buildRemote uploads the commit of the image as a tarball and builds it on the target
+func buildRemote(image docker.Image, b config.Build, c ssh.Credential) error {
+	dir := fmt.Sprintf("/tmp/shot-%s-%s-%d", docker.Tag(image.Branch), git.Short(image.SHA), time.Now().UnixNano())
+	build, err := docker.BuildArgs(image, b, dir)
+	if err != nil {
+		return fmt.Errorf("invalid build configuration: %v", err)
+	}
+
+	// The target does not have our environment, pass secret build args explicitly
+	var env []string
+	for _, k := range b.EnvArgs {
+		v := os.Getenv(k)
+		ssh.Mask(v)
+		env = append(env, fmt.Sprintf("%s=%s", k, utils.ShellQuote(v)))
+	}
+	cmd := fmt.Sprintf("rm -rf %[1]s && mkdir -p %[1]s && tar -x -C %[1]s && %[2]s; status=$?; rm -rf %[1]s; exit $status",
+		dir, strings.TrimSpace(strings.Join(env, " ")+" "+utils.ShellJoin(build)))
+
+	return pipe(func(w io.Writer) error {
+		return git.Archive(image.SHA, w)
+	}, func(r io.Reader) error {
+		_, err := ssh.RunWithInput(cmd, r, c)
+		return err
+	})
+}
+
+// transferImage streams a locally built image to the target with `docker save | docker load`
+func transferImage(image docker.Image, c ssh.Credential) error {
+	return pipe(func(w io.Writer) error {
+		return utils.ExecStream(w, "docker", "save", image.Ref(), image.BranchRef())
+	}, func(r io.Reader) error {
+		_, err := ssh.RunWithInput("docker load", r, c)
+		return err
+	})
+}
+
+// pipe streams what produce writes into consume and waits for both.
+// In dry-run mode they run one after the other so the plan prints in order.
+func pipe(produce func(io.Writer) error, consume func(io.Reader) error) error {
+	if utils.DryRun {
+		if err := produce(ioutil.Discard); err != nil {
+			return err
+		}
+		return consume(nil)
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := produce(pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	err := consume(pr)
+	pr.Close()
+
+	// A failing consumer makes the producer fail too, report the cause
+	if pErr := <-done; err == nil {
+		err = pErr
+	}
+	return err
+}
+
+// registryLogin logs in to every configured registry, on this machine when c is nil
+// or on the target otherwise. Passwords are given through stdin, never on the command line.
+func registryLogin(cfg *config.Config, c *ssh.Credential) error {
+	for _, r := range cfg.RegistryAuth.Registries {
+		secret, err := r.Secret()
+		if err != nil {
+			return err
+		}
+		ssh.Mask(secret)
+
+		args := []string{"docker", "login", "--username", r.Username, "--password-stdin", r.Host}
+		if c == nil {
+			l.Info(utils.ShellJoin(args))
+			_, err = utils.ExecWithInput(strings.NewReader(secret), args[0], args[1:]...)
+		} else {
+			_, err = ssh.RunWithInput(utils.ShellJoin(args), strings.NewReader(secret), *c)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot login to %s: %v", r.Host, err)
+		}
+	}
+
+	return nil
+}
+
+// registryLogout removes the credentials stored by registryLogin
+func registryLogout(cfg *config.Config, c *ssh.Credential) {
+	for _, r := range cfg.RegistryAuth.Registries {
+		args := []string{"docker", "logout", r.Host}
+		var err error
+		if c == nil {
+			_, err = utils.Exec(args[0], args[1:]...)
+		} else {
+			_, err = ssh.RunWithInput(utils.ShellJoin(args), nil, *c)
+		}
+		if err != nil {
+			l.Log(dflog.WarnLevel, fmt.Sprintf("Cannot logout from %s", r.Host), err, nil)
+		}
+	}
+}
+
+// findConfig returns the configuration file given by --config, the environment name
+// or SHOT_CONFIG, or discovers it in the repository root
+func findConfig(env string) string {
+	root, err := git.TopLevel()
+	if err != nil {
+		root = "."
+	}
+
+	path := *configPath
+	if path == "" && env == "" {
+		path = os.Getenv("SHOT_CONFIG")
+	}
+
+	file, err := config.Find(path, env, root)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return file
+}
+
+// loadConfig reads and validates the configuration file, printing every problem and
+// exiting when it is invalid so no server is touched with a broken configuration
+func loadConfig(configFile string) *config.Config {
+	cfg, err := config.Init(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if errs, ok := err.(config.Errors); ok {
+			fmt.Fprintf(os.Stderr, "%d problem(s) found in the configuration\n", len(errs))
+		}
+		os.Exit(1)
+	}
+	return cfg
+}
+
+func setLogging() {
+	level, err := dflog.ParseLevel(*logLevel)
+	if err != nil {
+		app.Fatalf("%v", err)
+	}
 	if *debug {
-		l.DebugMode = true
+		level = dflog.DebugLevel
+	}
+	l.SetLevel(level)
+
+	if err = l.SetFormat(dflog.Format(*logFormat)); err != nil {
+		app.Fatalf("%v", err)
+	}
+
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			app.Fatalf("cannot open log file: %v", err)
+		}
+		l.SetOutput(f)
+	}
+}
+
+// setDryRun switches every command to only be printed. Work is serialized so
+// the plan reads in order.
+func setDryRun() {
+	if *dryRun {
+		utils.DryRun = true
+		*parallel = 1
 	}
 }
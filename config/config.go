@@ -1,17 +1,34 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
+	"strings"
+)
 
-	"gopkg.in/yaml.v2"
+// Build modes decide where images are built and how they get to the target
+const (
+	// BuildModeLocal builds on this machine, pushes to the registry and pulls on the target
+	BuildModeLocal = "local"
+	// BuildModeRemote uploads the source over SSH and builds on the target
+	BuildModeRemote = "remote"
+	// BuildModeTransfer builds on this machine and streams the image to the target over SSH
+	BuildModeTransfer = "transfer"
 )
 
 // Target is a configuration to define some information which is necessary to setup server
 type Target struct {
-	Host     string   `yaml:"host"`
-	User     string   `yaml:"user"`
-	Port     int      `yaml:"port"`
-	Branches []string `yaml:"branches"`
+	Host      string   `yaml:"host"`
+	User      string   `yaml:"user"`
+	Port      int      `yaml:"port"`
+	Branches  []string `yaml:"branches"`
+	BuildMode string   `yaml:"build_mode"`
+}
+
+// Addr returns host:port of the target, which tells targets on the same host apart
+func (t Target) Addr() string {
+	return fmt.Sprintf("%s:%d", t.Host, t.Port)
 }
 
 // Project ...
@@ -19,6 +36,26 @@ type Project struct {
 	Name     string   `yaml:"name"`
 	Database Database `yaml:"database"`
 	Port     int      `yaml:"port"`
+	// TagTimestamp appends the build time to image tags, e.g. branch-1a2b3c4-20160726023332
+	TagTimestamp bool `yaml:"tag_timestamp"`
+	// KeepImages is how many of the latest images of a branch stay on targets for rollback,
+	// images used by a container are never removed
+	KeepImages int   `yaml:"keep_images"`
+	Build      Build `yaml:"build"`
+}
+
+// Build holds the options passed to `docker build`. Args, cache_from and labels
+// are templates which can refer to {{.Branch}}, {{.Tag}}, {{.SHA}} and {{.ShortSHA}}.
+type Build struct {
+	Dockerfile string            `yaml:"dockerfile"`
+	Context    string            `yaml:"context"`
+	Target     string            `yaml:"target"`
+	Platform   string            `yaml:"platform"`
+	Args       map[string]string `yaml:"args"`
+	// EnvArgs are build args whose values are read from the environment, use them for secrets
+	EnvArgs   []string          `yaml:"env_args"`
+	CacheFrom []string          `yaml:"cache_from"`
+	Labels    map[string]string `yaml:"labels"`
 }
 
 // Database ...
@@ -31,55 +68,253 @@ type Database struct {
 
 // Notification ...
 type Notification struct {
-	Slack Slack `yaml:"slack"`
-	Email Email `yaml:"email"`
+	Slack      Slack      `yaml:"slack"`
+	Teams      Teams      `yaml:"teams"`
+	Discord    Discord    `yaml:"discord"`
+	Mattermost Mattermost `yaml:"mattermost"`
+	Email      Email      `yaml:"email"`
+	Webhooks   []Webhook  `yaml:"webhooks"`
+	GitHub     Forge      `yaml:"github"`
+	GitLab     Forge      `yaml:"gitlab"`
+}
+
+// Forge sets up commit statuses and pull or merge request comments on GitHub or GitLab
+type Forge struct {
+	Enable bool `yaml:"enable"`
+	// Repo is the path of the repository, e.g. dwarvesf/shot, defaults to the one of the origin remote
+	Repo string `yaml:"repo"`
+	// APIURL is the base of the API of self-hosted instances, e.g. https://git.example.com/api/v4
+	APIURL string `yaml:"api_url"`
+	// TokenEnv names the environment variable holding the API token, GITHUB_TOKEN or GITLAB_TOKEN by default
+	TokenEnv string `yaml:"token_env"`
+	// Comment also comments the environment URL on the pull or merge request of the branch
+	Comment bool   `yaml:"comment"`
+	Only    Filter `yaml:"only"`
+}
+
+// Webhook receives every event as a JSON payload
+type Webhook struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// Secret signs payloads with HMAC-SHA256, the signature is sent in the X-Shot-Signature header
+	Secret string `yaml:"secret"`
+	Only   Filter `yaml:"only"`
+}
+
+// Events which can be notified
+const (
+	EventDeployStarted   = "deploy_started"
+	EventDeploySucceeded = "deploy_succeeded"
+	EventDeployFailed    = "deploy_failed"
+	EventDown            = "down"
+	EventRollback        = "rollback"
+)
+
+// Filter selects the events sent to a channel, every list which is set must match.
+// Branches and targets are patterns, e.g. release/*. Chat channels and email are
+// not sent deploy_started unless Events lists it.
+type Filter struct {
+	Events   []string `yaml:"events"`
+	Branches []string `yaml:"branches"`
+	Targets  []string `yaml:"targets"`
+}
+
+// Channel is a webhook, written as its URL alone when it gets every event
+type Channel struct {
+	URL  string `yaml:"url"`
+	Only Filter `yaml:"only"`
+}
+
+// UnmarshalYAML accepts a URL or a mapping
+func (c *Channel) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var url string
+	if err := unmarshal(&url); err == nil {
+		c.URL = url
+		return nil
+	}
+	type plain Channel
+	return unmarshal((*plain)(c))
 }
 
 // Slack ...
 type Slack struct {
-	Enable   bool     `yaml:"enable"`
-	Channels []string `yaml:"channels"`
+	Enable   bool      `yaml:"enable"`
+	Channels []Channel `yaml:"channels"`
+}
+
+// Teams holds Microsoft Teams incoming webhook URLs
+type Teams struct {
+	Enable   bool      `yaml:"enable"`
+	Channels []Channel `yaml:"channels"`
+}
+
+// Discord holds Discord webhook URLs
+type Discord struct {
+	Enable   bool      `yaml:"enable"`
+	Channels []Channel `yaml:"channels"`
+}
+
+// Mattermost holds Mattermost incoming webhook URLs
+type Mattermost struct {
+	Enable   bool      `yaml:"enable"`
+	Channels []Channel `yaml:"channels"`
+	// Username overrides the name posts are shown with, when the server allows it
+	Username string `yaml:"username"`
 }
 
 // Email ...
 type Email struct {
-	Enable     bool     `yaml:"enable"`
-	SMTP       SMTP     `yaml:"smtp"`
-	Recipients []string `yaml:"recipients"`
+	Enable     bool        `yaml:"enable"`
+	SMTP       SMTP        `yaml:"smtp"`
+	Recipients []Recipient `yaml:"recipients"`
+	// Only applies to every recipient, groups fall back to it for the lists they do not set
+	Only Filter `yaml:"only"`
+	// Templates replace the default subject and bodies of the emails
+	Templates EmailTemplates `yaml:"templates"`
 }
 
+// Recipient is an email address, or a group of addresses with their own filter,
+// e.g. only release branches for clients
+type Recipient struct {
+	To   []string `yaml:"to"`
+	Only Filter   `yaml:"only"`
+}
+
+// UnmarshalYAML accepts an address or a mapping
+func (r *Recipient) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var to string
+	if err := unmarshal(&to); err == nil {
+		r.To = []string{to}
+		return nil
+	}
+	type plain Recipient
+	return unmarshal((*plain)(r))
+}
+
+// EmailTemplates are Go templates rendered with the event, e.g. {{.Branch}}. Text and subject
+// are text/template, HTML is html/template. The emails have no HTML part when html is "-".
+type EmailTemplates struct {
+	Subject string `yaml:"subject"`
+	Text    string `yaml:"text"`
+	HTML    string `yaml:"html"`
+}
+
+// SMTP authentication methods
+const (
+	AuthPlain   = "plain"
+	AuthLogin   = "login"
+	AuthCRAMMD5 = "cram_md5"
+	AuthNone    = "none"
+)
+
 // SMTP ...
 type SMTP struct {
-	Domain         string `yaml:"domain"`
-	Host           string `yaml:"host"`
-	Port           int    `yaml:"port"`
-	User           string `yaml:"user"`
-	Pass           string `yaml:"pass"`
-	StartTLS       bool   `yaml:"starttls"`
+	Domain string `yaml:"domain"`
+	Host   string `yaml:"host"`
+	Port   int    `yaml:"port"`
+	User   string `yaml:"user"`
+	Pass   string `yaml:"pass"`
+	// StartTLS upgrades the connection to TLS: when unset whenever the server offers it, when true
+	// it is required and when false never done. TLS connects over TLS from the start (usually port 465)
+	StartTLS *bool `yaml:"starttls"`
+	TLS      bool  `yaml:"tls"`
+	// Authentication is plain (the default), login, cram_md5 or none
 	Authentication string `yaml:"authentication"`
 	FromName       string `yaml:"from_name"`
 	FromEmail      string `yaml:"from_email"`
 }
 
+// Rollout strategies
+const (
+	// RolloutAll works on all targets at once, this is the default
+	RolloutAll = "all"
+	// RolloutOneByOne works on one target after another
+	RolloutOneByOne = "one-by-one"
+	// RolloutBatch works on batch_size targets at a time
+	RolloutBatch = "batch"
+	// RolloutCanary works on the canary target first, then on all the others at once
+	RolloutCanary = "canary"
+)
+
+// Rollout decides the order in which targets are deployed or put down.
+// Targets which were not started yet are skipped once one of them fails.
+type Rollout struct {
+	Strategy  string `yaml:"strategy"`
+	BatchSize int    `yaml:"batch_size"`
+	// Canary is the host deployed first with the canary strategy, defaults to the first target
+	Canary string `yaml:"canary"`
+}
+
+// RegistryAuth lists the registries to `docker login` to before deploying
+type RegistryAuth struct {
+	Registries []Registry `yaml:"registries"`
+	// Logout removes stored credentials from this machine and the targets once done
+	Logout bool `yaml:"logout"`
+}
+
+// Registry holds the credentials of a docker registry. The password is read
+// from password_file or password_env when given, so it can be kept out of the config.
+type Registry struct {
+	Host         string `yaml:"host"`
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordEnv  string `yaml:"password_env"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+// Secret returns the password or token of the registry
+func (r Registry) Secret() (string, error) {
+	switch {
+	case r.PasswordFile != "":
+		b, err := ioutil.ReadFile(r.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	case r.PasswordEnv != "":
+		v := os.Getenv(r.PasswordEnv)
+		if v == "" {
+			return "", fmt.Errorf("environment variable %s is not set", r.PasswordEnv)
+		}
+		return v, nil
+	case r.Password != "":
+		return r.Password, nil
+	}
+
+	return "", fmt.Errorf("no password given for registry %s", r.Host)
+}
+
 // Config ...
 type Config struct {
 	Targets      []Target     `yaml:"targets"`
 	Project      Project      `yaml:"project"`
 	Notification Notification `yaml:"notification"`
 	Registry     string       `yaml:"registry"`
+	RegistryAuth RegistryAuth `yaml:"registry_auth"`
+	Rollout      Rollout      `yaml:"rollout"`
+	// BuildMode is used for targets which do not set their own, defaults to local
+	BuildMode string `yaml:"build_mode"`
 }
 
-// Init ...
-func Init(configFile string) (conf *Config, err error) {
-	configBytes, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		return nil, err
+// BuildModeOf returns the build mode used for given target
+func (c *Config) BuildModeOf(t Target) string {
+	if t.BuildMode != "" {
+		return t.BuildMode
+	}
+	if c.BuildMode != "" {
+		return c.BuildMode
 	}
+	return BuildModeLocal
+}
 
-	conf = &Config{}
-	if err = yaml.Unmarshal(configBytes, conf); err != nil {
+// Init reads and validates the configuration file. ${ENV_VAR} and `!file path` values are
+// interpolated, and files listed in `extends:` or `include:` are merged underneath it.
+// Problems are returned as Errors carrying the file and line they are found on.
+func Init(configFile string) (conf *Config, err error) {
+	sources, err := load(configFile, map[string]bool{})
+	if err != nil {
 		return nil, err
 	}
 
-	return conf, nil
+	return parse(sources)
 }
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Dir is the directory, relative to the repository root, holding one configuration per environment
+const Dir = ".shot"
+
+// defaultFiles are looked up in the repository root when no configuration is given
+var defaultFiles = []string{"shot.yml", "shot.yaml", filepath.Join(Dir, "shot.yml"), filepath.Join(Dir, "shot.yaml")}
+
+// Find returns the configuration file to use. An explicit path wins, then the environment
+// called name, e.g. feature__login for .shot/feature__login.yml, then shot.yml in root.
+// If there is none, the only file in .shot/ is used.
+func Find(path, name, root string) (string, error) {
+	if path != "" {
+		if name != "" {
+			return "", fmt.Errorf("cannot use both a configuration file (%s) and an environment name (%s)", path, name)
+		}
+		return path, nil
+	}
+
+	if name != "" {
+		candidates := []string{
+			filepath.Join(root, Dir, name+".yml"),
+			filepath.Join(root, Dir, name+".yaml"),
+			filepath.Join(root, name+".yml"),
+			filepath.Join(root, name+".yaml"),
+			name,
+		}
+		for _, c := range candidates {
+			if isFile(c) {
+				return c, nil
+			}
+		}
+
+		envs, _ := Environments(root)
+		if len(envs) == 0 {
+			return "", fmt.Errorf("no configuration found for environment %s in %s", name, filepath.Join(root, Dir))
+		}
+		return "", fmt.Errorf("no configuration found for environment %s, available: %s", name, strings.Join(envs, ", "))
+	}
+
+	for _, f := range defaultFiles {
+		if c := filepath.Join(root, f); isFile(c) {
+			return c, nil
+		}
+	}
+
+	envs, err := Environments(root)
+	if err != nil {
+		return "", err
+	}
+	switch len(envs) {
+	case 0:
+		return "", fmt.Errorf("no configuration found: pass --config, set SHOT_CONFIG or create shot.yml in %s", root)
+	case 1:
+		return Find("", envs[0], root)
+	}
+	return "", fmt.Errorf("several configurations found in %s, pick one of: %s", filepath.Join(root, Dir), strings.Join(envs, ", "))
+}
+
+// Environments lists the names of the configurations in the .shot directory of root
+func Environments(root string) ([]string, error) {
+	var envs []string
+	for _, pattern := range []string{"*.yml", "*.yaml"} {
+		matches, err := filepath.Glob(filepath.Join(root, Dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if isFile(m) {
+				envs = append(envs, strings.TrimSuffix(filepath.Base(m), filepath.Ext(m)))
+			}
+		}
+	}
+	sort.Strings(envs)
+
+	return envs, nil
+}
+
+func isFile(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
@@ -0,0 +1,305 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// source is one configuration file after interpolation
+type source struct {
+	file  string
+	doc   map[interface{}]interface{}
+	lines map[string]int
+}
+
+// envPattern matches ${VAR}, ${VAR:-default} (used when VAR is unset or empty) and
+// ${VAR-default} (used when VAR is unset). $${ escapes a literal ${.
+var envPattern = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:?-([^}]*))?\}`)
+
+// filePattern matches a value written as `!file path`
+var filePattern = regexp.MustCompile(`^(\s*(?:-\s+)*(?:[^\s#'"][^:#]*:\s+)?)!file\s+(.+?)\s*$`)
+
+// expand replaces the environment variables in s and returns the names of those which are not set
+func expand(s string) (string, []string) {
+	var unset []string
+	s = envPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if strings.HasPrefix(m, "$$") {
+			return m[1:]
+		}
+		sub := envPattern.FindStringSubmatch(m)
+		v, ok := os.LookupEnv(sub[1])
+		switch {
+		case strings.HasPrefix(sub[2], ":-"):
+			if v != "" {
+				return v
+			}
+			return sub[3]
+		case strings.HasPrefix(sub[2], "-"):
+			if ok {
+				return v
+			}
+			return sub[3]
+		case ok:
+			return v
+		}
+		unset = append(unset, sub[1])
+		return m
+	})
+	return s, unset
+}
+
+// readFiles replaces `!file` references in data by the quoted content of the file.
+// Relative references are resolved from dir.
+func readFiles(file string, data []byte, dir string) ([]byte, error) {
+	var errs Errors
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		m := filePattern.FindStringSubmatch(line)
+		if m == nil || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		path, unset := expand(m[2])
+		for _, name := range unset {
+			errs = append(errs, Error{File: file, Line: i + 1, Msg: fmt.Sprintf("environment variable %s is not set", name)})
+		}
+		if len(unset) != 0 {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			errs = append(errs, Error{File: file, Line: i + 1, Msg: err.Error()})
+			continue
+		}
+		// Secrets are taken as they are, never interpolated
+		v := strings.Replace(strings.TrimRight(string(b), "\r\n"), "${", "$${", -1)
+		lines[i] = m[1] + strconv.Quote(v)
+	}
+
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// interpolate replaces environment variables in the string values of the parsed document v.
+// Values are substituted once parsed so they are never read as YAML, whatever they contain.
+func interpolate(v interface{}, path string, errs *Errors) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		keys := make([]interface{}, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		for _, k := range keys {
+			v[k] = interpolate(v[k], joinPath(path, fmt.Sprint(k)), errs)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = interpolate(e, fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case string:
+		s, unset := expand(v)
+		for _, name := range unset {
+			errs.add(path, "environment variable %s is not set", name)
+		}
+		if s != v {
+			return scalar(s)
+		}
+	}
+	return v
+}
+
+// scalar reads s as a plain YAML value would be, so that a variable can give a number
+// or a boolean, e.g. `port: ${PORT}`. Anything YAML would not write back the same,
+// e.g. 0123 or yes, stays a string.
+func scalar(s string) interface{} {
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	switch v.(type) {
+	case int, int64, uint64, float64, bool:
+		if out, err := yaml.Marshal(v); err == nil && strings.TrimSpace(string(out)) == s {
+			return v
+		}
+	}
+	return s
+}
+
+// lineNumber matches the line yaml errors start with
+var lineNumber = regexp.MustCompile(`line (\d+): `)
+
+// checkTypes reports values of data which do not fit their field, but those still
+// to be interpolated: `port: ${PORT}` is not a number until it is.
+func checkTypes(file string, data []byte) error {
+	err := yaml.Unmarshal(data, &Config{})
+	te, ok := err.(*yaml.TypeError)
+	if !ok {
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		return nil
+	}
+
+	lines := strings.Split(string(data), "\n")
+	kept := &yaml.TypeError{}
+	for _, msg := range te.Errors {
+		if m := lineNumber.FindStringSubmatch(msg); m != nil {
+			if n, _ := strconv.Atoi(m[1]); n >= 1 && n <= len(lines) && strings.Contains(lines[n-1], "${") {
+				continue
+			}
+		}
+		kept.Errors = append(kept.Errors, msg)
+	}
+	if len(kept.Errors) != 0 {
+		return fmt.Errorf("%s: %v", file, kept)
+	}
+	return nil
+}
+
+// load reads file and the files it extends or includes, recursively.
+// Sources are returned in merge order: bases first, file last. chain holds the files
+// being loaded, from the top one down to file, a base shared by several files is fine.
+func load(file string, chain map[string]bool) ([]source, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	if chain[abs] {
+		return nil, fmt.Errorf("%s: extends or includes itself", file)
+	}
+	chain[abs] = true
+	defer delete(chain, abs)
+
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readFiles(file, raw, filepath.Dir(file))
+	if err != nil {
+		return nil, err
+	}
+
+	// Report type errors against the file they are in
+	if err = checkTypes(file, data); err != nil {
+		return nil, err
+	}
+	doc := map[interface{}]interface{}{}
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	lines := indexLines(data)
+
+	var errs Errors
+	interpolate(doc, "", &errs)
+	for i := range errs {
+		errs[i].File, errs[i].Line = file, lineOf(lines, errs[i].Path)
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	// Interpolated values are checked now, their lines in the file are not known to yaml
+	if out, err := yaml.Marshal(doc); err == nil {
+		if err = yaml.Unmarshal(out, &Config{}); err != nil {
+			return nil, fmt.Errorf("%s: %s", file, lineNumber.ReplaceAllString(err.Error(), ""))
+		}
+	}
+
+	var bases []string
+	if v, ok := doc["extends"].(string); ok && v != "" {
+		bases = append(bases, v)
+	}
+	if v, ok := doc["include"].([]interface{}); ok {
+		for _, b := range v {
+			bases = append(bases, fmt.Sprint(b))
+		}
+	}
+	delete(doc, "extends")
+	delete(doc, "include")
+
+	var sources []source
+	for _, b := range bases {
+		if !filepath.IsAbs(b) {
+			b = filepath.Join(filepath.Dir(file), b)
+		}
+		s, err := load(b, chain)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, s...)
+	}
+
+	return append(sources, source{file: file, doc: doc, lines: lines}), nil
+}
+
+// merge overlays src onto dst: mappings are merged key by key, anything else is replaced
+func merge(dst, src map[interface{}]interface{}) {
+	for k, v := range src {
+		sm, ok := v.(map[interface{}]interface{})
+		dm, dOk := dst[k].(map[interface{}]interface{})
+		if ok && dOk {
+			merge(dm, sm)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// parse merges the sources into a configuration and reports unknown keys and invalid values
+func parse(sources []source) (*Config, error) {
+	var errs Errors
+	doc := map[interface{}]interface{}{}
+	for _, s := range sources {
+		var sErrs Errors
+		checkKeys(s.doc, reflect.TypeOf(Config{}), "", &sErrs)
+		for _, e := range sErrs {
+			e.File, e.Line = s.file, lineOf(s.lines, e.Path)
+			errs = append(errs, e)
+		}
+		merge(doc, s.doc)
+	}
+
+	merged, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	conf := &Config{}
+	if err = yaml.Unmarshal(merged, conf); err != nil {
+		return nil, err
+	}
+
+	// Point at the last file setting the value, it is the one that counts
+	for _, e := range conf.Validate() {
+		e.File = sources[len(sources)-1].file
+		for i := len(sources) - 1; i >= 0; i-- {
+			if n, ok := sources[i].lines[e.Path]; ok {
+				e.File, e.Line = sources[i].file, n
+				break
+			}
+		}
+		for i := len(sources) - 1; i >= 0 && e.Line == 0; i-- {
+			if n := lineOf(sources[i].lines, e.Path); n != 0 {
+				e.File, e.Line = sources[i].file, n
+			}
+		}
+		errs = append(errs, e)
+	}
+
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return conf, nil
+}
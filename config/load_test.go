@@ -0,0 +1,278 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestExpand(t *testing.T) {
+	t.Setenv("SHOT_SET", "value")
+	t.Setenv("SHOT_EMPTY", "")
+
+	tests := []struct {
+		in    string
+		want  string
+		unset []string
+	}{
+		{"${SHOT_SET}", "value", nil},
+		{"a-${SHOT_SET}-b", "a-value-b", nil},
+		{"${SHOT_EMPTY}", "", nil},
+		{"${SHOT_UNSET}", "${SHOT_UNSET}", []string{"SHOT_UNSET"}},
+		{"${SHOT_SET:-d}", "value", nil},
+		{"${SHOT_EMPTY:-d}", "d", nil},
+		{"${SHOT_UNSET:-d}", "d", nil},
+		{"${SHOT_SET-d}", "value", nil},
+		{"${SHOT_EMPTY-d}", "", nil},
+		{"${SHOT_UNSET-d}", "d", nil},
+		{"${SHOT_UNSET:-}", "", nil},
+		{"$${SHOT_SET}", "${SHOT_SET}", nil},
+		{"$$${SHOT_SET}", "$${SHOT_SET}", nil},
+		{"$SHOT_SET", "$SHOT_SET", nil},
+		{"${SHOT_UNSET}${SHOT_OTHER}", "${SHOT_UNSET}${SHOT_OTHER}", []string{"SHOT_UNSET", "SHOT_OTHER"}},
+	}
+	for _, tt := range tests {
+		got, unset := expand(tt.in)
+		if got != tt.want || !reflect.DeepEqual(unset, tt.unset) {
+			t.Errorf("expand(%q) = %q, %v, want %q, %v", tt.in, got, unset, tt.want, tt.unset)
+		}
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	t.Setenv("SHOT_PASS", "abc #def")
+	t.Setenv("SHOT_PORT", "8080")
+	t.Setenv("SHOT_YAML", "a: b")
+	t.Setenv("SHOT_OCTAL", "0123")
+
+	data := `project:
+  port: ${SHOT_PORT}
+notification:
+  email:
+    smtp:
+      pass: ${SHOT_PASS}
+      user: ${SHOT_YAML}
+      from_name: ${SHOT_OCTAL}
+      from_email: "$${SHOT_PASS}"
+targets:
+  - host: ${SHOT_MISSING}
+    branches: [master, "${SHOT_PORT}"]
+`
+	doc := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal([]byte(data), &doc); err != nil {
+		t.Fatal(err)
+	}
+	var errs Errors
+	interpolate(doc, "", &errs)
+
+	want := map[interface{}]interface{}{
+		"project": map[interface{}]interface{}{"port": 8080},
+		"notification": map[interface{}]interface{}{
+			"email": map[interface{}]interface{}{
+				"smtp": map[interface{}]interface{}{
+					"pass":       "abc #def",
+					"user":       "a: b",
+					"from_name":  "0123",
+					"from_email": "${SHOT_PASS}",
+				},
+			},
+		},
+		"targets": []interface{}{
+			map[interface{}]interface{}{
+				"host":     "${SHOT_MISSING}",
+				"branches": []interface{}{"master", 8080},
+			},
+		},
+	}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("interpolate() = %v, want %v", doc, want)
+	}
+	if len(errs) != 1 || errs[0].Path != "targets[0].host" || !strings.Contains(errs[0].Msg, "SHOT_MISSING") {
+		t.Errorf("interpolate() errors = %v, want SHOT_MISSING unset at targets[0].host", errs)
+	}
+}
+
+func TestReadFiles(t *testing.T) {
+	dir := t.TempDir()
+	write(t, dir, "secret", "p#ss: ${NOT_A_VAR}\n")
+	t.Setenv("SHOT_DIR", dir)
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+		err  string
+	}{
+		{
+			name: "relative path",
+			in:   "pass: !file secret",
+			want: `pass: "p#ss: $${NOT_A_VAR}"`,
+		},
+		{
+			name: "sequence item",
+			in:   "  - !file secret",
+			want: `  - "p#ss: $${NOT_A_VAR}"`,
+		},
+		{
+			name: "path from the environment",
+			in:   "pass: !file ${SHOT_DIR}/secret",
+			want: `pass: "p#ss: $${NOT_A_VAR}"`,
+		},
+		{
+			name: "comment",
+			in:   "# pass: !file missing",
+			want: "# pass: !file missing",
+		},
+		{
+			name: "missing file",
+			in:   "pass: !file missing",
+			err:  "c.yml:1: open " + filepath.Join(dir, "missing"),
+		},
+		{
+			name: "unset variable in path",
+			in:   "pass: !file ${SHOT_UNSET}/secret",
+			err:  "c.yml:1: environment variable SHOT_UNSET is not set",
+		},
+	}
+	for _, tt := range tests {
+		got, err := readFiles("c.yml", []byte(tt.in), dir)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: readFiles() = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	// The content of the file is taken as it is, never interpolated
+	t.Setenv("NOT_A_VAR", "oops")
+	data, err := readFiles("c.yml", []byte("pass: !file secret"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := map[interface{}]interface{}{}
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	var errs Errors
+	interpolate(doc, "", &errs)
+	if doc["pass"] != "p#ss: ${NOT_A_VAR}" {
+		t.Errorf("pass = %q, want the file content", doc["pass"])
+	}
+}
+
+func TestCheckTypes(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"valid", "project:\n  port: 8080\n", ""},
+		{"not a number", "project:\n  port: abc\n", "line 2: cannot unmarshal !!str `abc` into int"},
+		{"interpolated later", "project:\n  port: ${SHOT_PORT}\n", ""},
+		{"syntax error", "project: [\n", "c.yml: yaml:"},
+	}
+	for _, tt := range tests {
+		err := checkTypes("c.yml", []byte(tt.data))
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: checkTypes() = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	dst := map[interface{}]interface{}{
+		"registry": "hub.example.com",
+		"project":  map[interface{}]interface{}{"name": "base", "port": 80},
+		"targets":  []interface{}{"a", "b"},
+	}
+	src := map[interface{}]interface{}{
+		"project": map[interface{}]interface{}{"port": 8080},
+		"targets": []interface{}{"c"},
+		"rollout": "one_by_one",
+	}
+	merge(dst, src)
+
+	want := map[interface{}]interface{}{
+		"registry": "hub.example.com",
+		"project":  map[interface{}]interface{}{"name": "base", "port": 8080},
+		"targets":  []interface{}{"c"},
+		"rollout":  "one_by_one",
+	}
+	if !reflect.DeepEqual(dst, want) {
+		t.Errorf("merge() = %v, want %v", dst, want)
+	}
+}
+
+func TestInitExtends(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("SHOT_PROJECT_PORT", "3000")
+	write(t, dir, "base.yml", `targets:
+  - host: 10.0.0.1
+    port: 22
+    user: root
+    branches: [master]
+project:
+  name: acme/api
+  port: 8080
+registry: hub.example.com
+`)
+	write(t, dir, "notify.yml", `notification:
+  slack:
+    enable: true
+    channels:
+      - https://hooks.slack.com/services/x
+`)
+	write(t, dir, "feature.yml", `extends: base.yml
+include: [notify.yml]
+project:
+  port: ${SHOT_PROJECT_PORT}
+`)
+
+	cfg, err := Init(filepath.Join(dir, "feature.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Project.Name != "acme/api" || cfg.Project.Port != 3000 {
+		t.Errorf("project = %+v, want the name of the base and the port of the file", cfg.Project)
+	}
+	if len(cfg.Targets) != 1 || cfg.Targets[0].Host != "10.0.0.1" {
+		t.Errorf("targets = %+v, want those of the base", cfg.Targets)
+	}
+	if !cfg.Notification.Slack.Enable || len(cfg.Notification.Slack.Channels) != 1 {
+		t.Errorf("slack = %+v, want the included one", cfg.Notification.Slack)
+	}
+
+	// Errors point at the file setting the value
+	write(t, dir, "bad.yml", "extends: base.yml\nproject:\n  port: 70000\n")
+	_, err = Init(filepath.Join(dir, "bad.yml"))
+	if err == nil || !strings.Contains(err.Error(), "bad.yml:3: project.port") {
+		t.Errorf("Init() error = %v, want it on bad.yml:3", err)
+	}
+
+	// A base may be shared, by the extended file and an include here
+	write(t, dir, "shared.yml", "extends: base.yml\ninclude: [notify.yml, feature.yml]\n")
+	if cfg, err = Init(filepath.Join(dir, "shared.yml")); err != nil || cfg.Project.Port != 3000 {
+		t.Errorf("Init() = %+v, %v, want base.yml loaded twice", cfg, err)
+	}
+
+	write(t, dir, "loop.yml", "extends: loop2.yml\n")
+	write(t, dir, "loop2.yml", "include: [notify.yml, loop.yml]\n")
+	if _, err = Init(filepath.Join(dir, "loop.yml")); err == nil || !strings.Contains(err.Error(), "loop.yml: extends or includes itself") {
+		t.Errorf("Init() error = %v, want the loop reported", err)
+	}
+}
+
+func write(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
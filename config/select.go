@@ -0,0 +1,77 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// IsPattern reports whether the branch is a glob pattern such as feature/*
+func IsPattern(branch string) bool {
+	return strings.ContainsAny(branch, "*?[")
+}
+
+// Select narrows the targets down to the given hosts, which may be glob patterns, and when
+// branches are given makes every remaining target use them instead of its own. Branch
+// patterns are expanded with resolve, which returns the branches matching a pattern.
+// A target left without branches, as none are configured nor given, is an error.
+func (c *Config) Select(hosts, branches []string, resolve func(pattern string) ([]string, error)) error {
+	for _, b := range branches {
+		if IsPattern(b) {
+			if _, err := path.Match(b, ""); err != nil {
+				return fmt.Errorf("invalid branch pattern %q: %v", b, err)
+			}
+			continue
+		}
+		if msg := checkBranchName(b); msg != "" {
+			return fmt.Errorf("invalid branch %q: %s", b, msg)
+		}
+	}
+
+	if len(hosts) != 0 {
+		var targets []Target
+		for _, t := range c.Targets {
+			for _, h := range hosts {
+				if ok, _ := path.Match(h, t.Host); ok {
+					targets = append(targets, t)
+					break
+				}
+			}
+		}
+		if len(targets) == 0 {
+			return fmt.Errorf("no target matches %s", strings.Join(hosts, ", "))
+		}
+		c.Targets = targets
+	}
+
+	for i := range c.Targets {
+		t := &c.Targets[i]
+		if len(branches) != 0 {
+			t.Branches = branches
+		}
+		if len(t.Branches) == 0 {
+			return fmt.Errorf("target %s has no branches, list them in its configuration or use --branch", t.Host)
+		}
+
+		seen := map[string]bool{}
+		var expanded []string
+		for _, b := range t.Branches {
+			matches := []string{b}
+			if IsPattern(b) {
+				var err error
+				if matches, err = resolve(b); err != nil {
+					return fmt.Errorf("cannot resolve branch pattern %q: %v", b, err)
+				}
+			}
+			for _, m := range matches {
+				if !seen[m] {
+					seen[m] = true
+					expanded = append(expanded, m)
+				}
+			}
+		}
+		t.Branches = expanded
+	}
+
+	return nil
+}
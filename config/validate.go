@@ -0,0 +1,471 @@
+package config
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Error is a problem found in a configuration file
+type Error struct {
+	File string
+	// Line is 0 when the position of the problem is not known
+	Line int
+	Path string
+	Msg  string
+}
+
+func (e Error) Error() string {
+	pos := e.File
+	if e.Line != 0 {
+		pos = fmt.Sprintf("%s:%d", pos, e.Line)
+	}
+	if pos != "" {
+		pos += ": "
+	}
+	if e.Path == "" {
+		return pos + e.Msg
+	}
+	return fmt.Sprintf("%s%s: %s", pos, e.Path, e.Msg)
+}
+
+// Errors lists every problem found in a configuration file, one per line
+type Errors []Error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e *Errors) add(path, format string, args ...interface{}) {
+	*e = append(*e, Error{Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks conf for missing, invalid and conflicting values
+func (c *Config) Validate() Errors {
+	var errs Errors
+
+	if c.Project.Name == "" {
+		errs.add("project.name", "is required")
+	}
+	if !validPort(c.Project.Port) {
+		errs.add("project.port", "must be between 1 and 65535")
+	}
+	if c.Project.KeepImages < 0 {
+		errs.add("project.keep_images", "must not be negative")
+	}
+	if !validBuildMode(c.BuildMode) {
+		errs.add("build_mode", "must be one of local, remote or transfer")
+	}
+
+	if len(c.Targets) == 0 {
+		errs.add("targets", "at least one target is required")
+	}
+	hosts := map[string]int{}
+	needsRegistry := false
+	for i, t := range c.Targets {
+		path := fmt.Sprintf("targets[%d]", i)
+		if t.Host == "" {
+			errs.add(path+".host", "is required")
+		}
+		if t.User == "" {
+			errs.add(path+".user", "is required")
+		}
+		if !validPort(t.Port) {
+			errs.add(path+".port", "must be between 1 and 65535")
+		}
+		addr := t.Addr()
+		if j, ok := hosts[addr]; ok {
+			errs.add(path, "duplicates targets[%d] (%s)", j, addr)
+		} else {
+			hosts[addr] = i
+		}
+		if !validBuildMode(t.BuildMode) {
+			errs.add(path+".build_mode", "must be one of local, remote or transfer")
+		}
+		if c.BuildModeOf(t) == BuildModeLocal {
+			needsRegistry = true
+		}
+
+		// Branches run in containers named after them, two branches must not end up with the same name
+		names := map[string]string{}
+		for j, b := range t.Branches {
+			bPath := fmt.Sprintf("%s.branches[%d]", path, j)
+			if IsPattern(b) {
+				if _, err := filepath.Match(b, ""); err != nil {
+					errs.add(bPath, "%q is not a valid pattern", b)
+				}
+				continue
+			}
+			if msg := checkBranchName(b); msg != "" {
+				errs.add(bPath, "%q %s", b, msg)
+				continue
+			}
+			name := strings.Replace(b, "/", "-", -1)
+			if other, ok := names[name]; ok {
+				if other == b {
+					errs.add(bPath, "branch %q is listed twice", b)
+				} else {
+					errs.add(bPath, "branch %q would use the same container as %q", b, other)
+				}
+				continue
+			}
+			names[name] = b
+		}
+	}
+
+	if needsRegistry && c.Registry == "" {
+		errs.add("registry", "is required by targets using the local build mode")
+	}
+	for i, r := range c.RegistryAuth.Registries {
+		path := fmt.Sprintf("registry_auth.registries[%d]", i)
+		if r.Host == "" {
+			errs.add(path+".host", "is required")
+		}
+		if r.Username == "" {
+			errs.add(path+".username", "is required")
+		}
+	}
+
+	switch c.Rollout.Strategy {
+	case "", RolloutAll, RolloutOneByOne, RolloutCanary:
+	case RolloutBatch:
+		if c.Rollout.BatchSize < 1 {
+			errs.add("rollout.batch_size", "must be at least 1 with the batch strategy")
+		}
+	default:
+		errs.add("rollout.strategy", "must be one of all, one-by-one, batch or canary")
+	}
+	if c.Rollout.Canary != "" {
+		found := false
+		for _, t := range c.Targets {
+			found = found || t.Host == c.Rollout.Canary
+		}
+		if !found {
+			errs.add("rollout.canary", "%q is not one of the targets", c.Rollout.Canary)
+		}
+	}
+
+	webhooks := []struct {
+		name     string
+		enable   bool
+		channels []Channel
+	}{
+		{"slack", c.Notification.Slack.Enable, c.Notification.Slack.Channels},
+		{"teams", c.Notification.Teams.Enable, c.Notification.Teams.Channels},
+		{"discord", c.Notification.Discord.Enable, c.Notification.Discord.Channels},
+		{"mattermost", c.Notification.Mattermost.Enable, c.Notification.Mattermost.Channels},
+	}
+	for _, w := range webhooks {
+		if !w.enable {
+			continue
+		}
+		if len(w.channels) == 0 {
+			errs.add("notification."+w.name+".channels", "at least one webhook is required when %s is enabled", w.name)
+		}
+		for i, ch := range w.channels {
+			path := fmt.Sprintf("notification.%s.channels[%d]", w.name, i)
+			if !validURL(ch.URL) {
+				errs.add(path, "must be a webhook URL")
+			}
+			checkFilter(path+".only", ch.Only, &errs)
+		}
+	}
+	for i, w := range c.Notification.Webhooks {
+		path := fmt.Sprintf("notification.webhooks[%d]", i)
+		if !validURL(w.URL) {
+			errs.add(path+".url", "must be an http or https URL")
+		}
+		for k := range w.Headers {
+			if k == "" || strings.ContainsAny(k, " :\t\r\n") {
+				errs.add(path+".headers", "%q is not a valid header name", k)
+			}
+		}
+		checkFilter(path+".only", w.Only, &errs)
+	}
+	forges := []struct {
+		name  string
+		forge Forge
+	}{{"github", c.Notification.GitHub}, {"gitlab", c.Notification.GitLab}}
+	for _, f := range forges {
+		if f.forge.Enable && f.forge.APIURL != "" && !validURL(f.forge.APIURL) {
+			errs.add("notification."+f.name+".api_url", "must be an http or https URL")
+		}
+		checkFilter("notification."+f.name+".only", f.forge.Only, &errs)
+	}
+	if c.Notification.Email.Enable {
+		checkFilter("notification.email.only", c.Notification.Email.Only, &errs)
+		smtp := c.Notification.Email.SMTP
+		if smtp.Host == "" {
+			errs.add("notification.email.smtp.host", "is required when email is enabled")
+		}
+		if !validPort(smtp.Port) {
+			errs.add("notification.email.smtp.port", "must be between 1 and 65535")
+		}
+		if smtp.StartTLS != nil && *smtp.StartTLS && smtp.TLS {
+			errs.add("notification.email.smtp.tls", "cannot be used together with starttls")
+		}
+		switch smtp.Authentication {
+		case "", AuthPlain, AuthLogin, AuthCRAMMD5:
+			if smtp.User == "" {
+				errs.add("notification.email.smtp.user", "is required to authenticate, set authentication to none otherwise")
+			}
+		case AuthNone:
+		default:
+			errs.add("notification.email.smtp.authentication", "must be one of plain, login, cram_md5 or none")
+		}
+		tpl := c.Notification.Email.Templates
+		for _, t := range []struct{ name, text string }{{"subject", tpl.Subject}, {"text", tpl.Text}} {
+			if _, err := texttemplate.New(t.name).Parse(t.text); err != nil {
+				errs.add("notification.email.templates."+t.name, "%v", err)
+			}
+		}
+		if _, err := htmltemplate.New("html").Parse(tpl.HTML); err != nil {
+			errs.add("notification.email.templates.html", "%v", err)
+		}
+		if smtp.FromEmail == "" && !strings.Contains(smtp.User, "@") {
+			errs.add("notification.email.smtp.from_email", "is required when user is not an email address")
+		}
+		if len(c.Notification.Email.Recipients) == 0 {
+			errs.add("notification.email.recipients", "at least one recipient is required when email is enabled")
+		}
+		for i, r := range c.Notification.Email.Recipients {
+			path := fmt.Sprintf("notification.email.recipients[%d]", i)
+			if len(r.To) == 0 {
+				errs.add(path+".to", "at least one address is required")
+			}
+			for j, to := range r.To {
+				if !strings.Contains(to, "@") {
+					errs.add(fmt.Sprintf("%s.to[%d]", path, j), "%q is not an email address", to)
+				}
+			}
+			checkFilter(path+".only", r.Only, &errs)
+		}
+	}
+
+	return errs
+}
+
+// checkFilter reports unknown events and invalid patterns of a notification filter
+func checkFilter(path string, f Filter, errs *Errors) {
+	for i, e := range f.Events {
+		switch e {
+		case EventDeployStarted, EventDeploySucceeded, EventDeployFailed, EventDown, EventRollback:
+		default:
+			errs.add(fmt.Sprintf("%s.events[%d]", path, i), "must be one of deploy_started, deploy_succeeded, deploy_failed, down or rollback")
+		}
+	}
+	for i, b := range f.Branches {
+		if _, err := filepath.Match(b, ""); err != nil {
+			errs.add(fmt.Sprintf("%s.branches[%d]", path, i), "%q is not a valid pattern", b)
+		}
+	}
+	for i, t := range f.Targets {
+		if _, err := filepath.Match(t, ""); err != nil {
+			errs.add(fmt.Sprintf("%s.targets[%d]", path, i), "%q is not a valid pattern", t)
+		}
+	}
+}
+
+func validPort(p int) bool {
+	return p > 0 && p < 65536
+}
+
+func validBuildMode(m string) bool {
+	switch m {
+	case "", BuildModeLocal, BuildModeRemote, BuildModeTransfer:
+		return true
+	}
+	return false
+}
+
+func validURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// invalidRefChars are the characters git does not allow in branch names
+var invalidRefChars = regexp.MustCompile(`[\x00-\x20~^:?*\[\\\x7f]`)
+
+// checkBranchName follows the rules of `git check-ref-format --branch`,
+// it returns why the name is invalid or an empty string
+func checkBranchName(b string) string {
+	switch {
+	case b == "":
+		return "is empty"
+	case invalidRefChars.MatchString(b):
+		return "contains spaces or one of ~^:?*[\\"
+	case strings.HasPrefix(b, "-"):
+		return "starts with a dash"
+	case strings.Contains(b, ".."), strings.Contains(b, "@{"), strings.Contains(b, "//"):
+		return `contains "..", "@{" or "//"`
+	case strings.HasPrefix(b, "/"), strings.HasSuffix(b, "/"), strings.HasSuffix(b, "."), strings.HasSuffix(b, ".lock"):
+		return `starts or ends with "/", or ends with "." or ".lock"`
+	}
+	return ""
+}
+
+// checkKeys reports keys of the parsed document v which have no field in t
+func checkKeys(v interface{}, t reflect.Type, path string, errs *Errors) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			if name != "-" {
+				fields[name] = f.Type
+			}
+		}
+
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, fmt.Sprint(k))
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ft, ok := fields[k]
+			if !ok {
+				errs.add(joinPath(path, k), "unknown key")
+				continue
+			}
+			checkKeys(m[k], ft, joinPath(path, k), errs)
+		}
+	case reflect.Slice:
+		s, ok := v.([]interface{})
+		if !ok {
+			return
+		}
+		for i, e := range s {
+			checkKeys(e, t.Elem(), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case reflect.Map:
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return
+		}
+		for k, e := range m {
+			checkKeys(e, t.Elem(), joinPath(path, fmt.Sprint(k)), errs)
+		}
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// keyPattern matches a `key: value` line of a block mapping
+var keyPattern = regexp.MustCompile(`^("[^"]*"|'[^']*'|[^\s#'"][^:#]*?)\s*:(\s|$)`)
+
+// indexLines maps the path of every key and sequence item of a YAML document,
+// e.g. targets[0].port, to the line it is on. Only block style is understood,
+// which is what configuration files are written in.
+func indexLines(data []byte) map[string]int {
+	type frame struct {
+		indent int
+		path   string
+		item   bool
+	}
+
+	lines := map[string]int{}
+	items := map[string]int{}
+	var stack []frame
+	scalarIndent := -1
+	for i, raw := range strings.Split(string(data), "\n") {
+		raw = strings.TrimRight(raw, "\r")
+		content := strings.TrimLeft(raw, " ")
+		indent := len(raw) - len(content)
+		if content == "" || content[0] == '#' {
+			continue
+		}
+		// Skip the lines of a literal or folded block scalar
+		if scalarIndent >= 0 {
+			if indent > scalarIndent {
+				continue
+			}
+			scalarIndent = -1
+		}
+
+		// Sequence items, their content is indented past the dash
+		for content == "-" || strings.HasPrefix(content, "- ") {
+			for len(stack) > 0 && (stack[len(stack)-1].indent > indent || stack[len(stack)-1].indent == indent && stack[len(stack)-1].item) {
+				stack = stack[:len(stack)-1]
+			}
+			parent := ""
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1].path
+			}
+			path := fmt.Sprintf("%s[%d]", parent, items[parent])
+			items[parent]++
+			lines[path] = i + 1
+			stack = append(stack, frame{indent, path, true})
+
+			rest := strings.TrimLeft(content[1:], " ")
+			indent += len(content) - len(rest)
+			content = rest
+		}
+		if content == "" {
+			continue
+		}
+
+		m := keyPattern.FindStringSubmatch(content)
+		if m == nil {
+			continue
+		}
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		parent := ""
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1].path
+		}
+		path := joinPath(parent, strings.Trim(m[1], `"'`))
+		lines[path] = i + 1
+		stack = append(stack, frame{indent, path, false})
+
+		value := strings.TrimSpace(content[len(m[0]):])
+		if strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">") {
+			scalarIndent = indent
+		}
+	}
+
+	return lines
+}
+
+// lineOf returns the line of path, or of its closest parent found in lines
+func lineOf(lines map[string]int, path string) int {
+	for path != "" {
+		if n, ok := lines[path]; ok {
+			return n
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return 0
+}
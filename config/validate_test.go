@@ -0,0 +1,162 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestIndexLines(t *testing.T) {
+	data := `# comment
+targets:
+  - host: 10.0.0.1
+    branches:
+      - master
+      - feature/login
+  - host: 10.0.0.2
+    port: 22
+project:
+  name: acme/api
+  build:
+    args:
+      "GO VERSION": "1.20"
+notification:
+  email:
+    templates:
+      text: |
+        port: not a key
+        - not an item
+    recipients:
+      - to: [a@b.c]
+`
+	want := map[string]int{
+		"targets":                             2,
+		"targets[0]":                          3,
+		"targets[0].host":                     3,
+		"targets[0].branches":                 4,
+		"targets[0].branches[0]":              5,
+		"targets[0].branches[1]":              6,
+		"targets[1]":                          7,
+		"targets[1].host":                     7,
+		"targets[1].port":                     8,
+		"project":                             9,
+		"project.name":                        10,
+		"project.build":                       11,
+		"project.build.args":                  12,
+		"project.build.args.GO VERSION":       13,
+		"notification":                        14,
+		"notification.email":                  15,
+		"notification.email.templates":        16,
+		"notification.email.templates.text":   17,
+		"notification.email.recipients":       20,
+		"notification.email.recipients[0]":    21,
+		"notification.email.recipients[0].to": 21,
+	}
+	if got := indexLines([]byte(data)); !reflect.DeepEqual(got, want) {
+		t.Errorf("indexLines() = %v, want %v", got, want)
+	}
+}
+
+func TestLineOf(t *testing.T) {
+	lines := map[string]int{
+		"targets":         1,
+		"targets[0]":      2,
+		"targets[0].port": 3,
+	}
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"targets[0].port", 3},
+		{"targets[0].user", 2},
+		{"targets[1].port", 1},
+		{"project.port", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := lineOf(lines, tt.path); got != tt.want {
+			t.Errorf("lineOf(%q) = %d, want %d", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCheckBranchName(t *testing.T) {
+	tests := []struct {
+		branch string
+		valid  bool
+	}{
+		{"master", true},
+		{"feature/login", true},
+		{"release-1.2", true},
+		{"", false},
+		{"feature login", false},
+		{"a~b", false},
+		{"a^b", false},
+		{"a:b", false},
+		{"a?b", false},
+		{"a*b", false},
+		{"a[b", false},
+		{`a\b`, false},
+		{"-a", false},
+		{"a..b", false},
+		{"a@{b", false},
+		{"a//b", false},
+		{"/a", false},
+		{"a/", false},
+		{"a.", false},
+		{"a.lock", false},
+	}
+	for _, tt := range tests {
+		if msg := checkBranchName(tt.branch); (msg == "") != tt.valid {
+			t.Errorf("checkBranchName(%q) = %q, want valid %v", tt.branch, msg, tt.valid)
+		}
+	}
+}
+
+func TestCheckKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{
+			name: "known keys",
+			data: "targets:\n  - host: a\n    branches: [master]\nproject:\n  build:\n    args:\n      ANY: x\n",
+		},
+		{
+			name: "unknown top level key",
+			data: "registyr: hub.example.com\n",
+			want: []string{"registyr"},
+		},
+		{
+			name: "unknown key in a list",
+			data: "targets:\n  - host: a\n  - hots: b\n    branchs: [master]\n",
+			want: []string{"targets[1].branchs", "targets[1].hots"},
+		},
+		{
+			name: "unknown key under a map of structs",
+			data: "notification:\n  slack:\n    channels:\n      - url: https://x\n        only:\n          event: [down]\n",
+			want: []string{"notification.slack.channels[0].only.event"},
+		},
+		{
+			name: "scalar for a struct is left to yaml",
+			data: "notification:\n  slack:\n    channels:\n      - https://x\n",
+		},
+	}
+	for _, tt := range tests {
+		doc := map[interface{}]interface{}{}
+		if err := yaml.Unmarshal([]byte(tt.data), &doc); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var errs Errors
+		checkKeys(doc, reflect.TypeOf(Config{}), "", &errs)
+		var got []string
+		for _, e := range errs {
+			got = append(got, e.Path)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: unknown keys %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -2,6 +2,7 @@
 package dflog
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"runtime"
@@ -11,6 +12,7 @@ import (
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 // M is sort form for logrus.Fields
@@ -19,10 +21,10 @@ type M map[string]interface{}
 // Fields is alias for logrus.Fields
 type Fields map[string]interface{}
 
-// Logger wraps logrus.Logger
+// Logger wraps logrus.Logger. All loggers share their level, format and output:
+// setting them on one sets them for every package.
 type Logger struct {
-	lg        *log.Logger
-	DebugMode bool
+	lg *log.Logger
 }
 
 // Level type
@@ -84,15 +86,70 @@ type Entry struct {
 	*log.Entry
 }
 
+// ParseLevel converts a level name, e.g. "warn", to a Level
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return DebugLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	case "fatal":
+		return FatalLevel, nil
+	case "panic":
+		return PanicLevel, nil
+	}
+	return InfoLevel, fmt.Errorf("unknown log level %q", name)
+}
+
+// Format is how entries are written
+type Format string
+
+// Formats of entries
+const (
+	// FormatText is readable by humans, coloured on terminals
+	FormatText Format = "text"
+	// FormatJSON writes an object per line
+	FormatJSON Format = "json"
+	// FormatLogfmt writes key=value pairs
+	FormatLogfmt Format = "logfmt"
+)
+
+// Formats lists the names of the formats entries can be written in
+var Formats = []string{string(FormatText), string(FormatJSON), string(FormatLogfmt)}
+
+// std is the logger behind every Logger, format is how it writes entries
+var (
+	std    = log.New()
+	format = FormatText
+)
+
 func init() {
-	log.SetFormatter(&log.JSONFormatter{})
-	log.SetOutput(os.Stderr)
+	std.Out = os.Stderr
+	std.Formatter = formatter(format, std.Out)
+}
+
+// formatter returns the logrus formatter writing entries in format to out.
+// Text is only coloured on terminals, log files must not get escape codes.
+func formatter(format Format, out io.Writer) log.Formatter {
+	switch format {
+	case FormatJSON:
+		return &log.JSONFormatter{}
+	case FormatLogfmt:
+		return &log.TextFormatter{DisableColors: true, FullTimestamp: true, TimestampFormat: time.RFC3339}
+	}
+	f, ok := out.(interface {
+		Fd() uintptr
+	})
+	return &log.TextFormatter{DisableColors: !ok || !terminal.IsTerminal(int(f.Fd())), FullTimestamp: true}
 }
 
 // New creates new Logger.
 func New() Logger {
-	logger := log.New()
-	return Logger{logger, false}
+	return Logger{std}
 }
 
 // 2015-06-10 20:10:08.123456
@@ -156,19 +213,32 @@ func getInfo() map[string]interface{} {
 	}
 }
 
-// SetFormatter sets formatter for logger.
-func (l Logger) SetFormatter(formatter log.Formatter) {
-	l.lg.Formatter = formatter
+// SetFormat sets how entries are written.
+func (l Logger) SetFormat(f Format) error {
+	switch f {
+	case FormatText, FormatJSON, FormatLogfmt:
+	default:
+		return fmt.Errorf("unknown log format %q", f)
+	}
+	format = f
+	l.lg.Formatter = formatter(format, l.lg.Out)
+	return nil
 }
 
-// SetLevel sets log level for logger.
-func (l Logger) SetLevel(level log.Level) {
-	l.lg.Level = level
+// SetLevel sets the least severe level logged, entries below it are dropped.
+func (l Logger) SetLevel(level Level) {
+	l.lg.Level = log.Level(level)
+}
+
+// GetLevel returns the least severe level logged.
+func (l Logger) GetLevel() Level {
+	return Level(l.lg.Level)
 }
 
 // SetOutput sets output for logger.
 func (l Logger) SetOutput(out io.Writer) {
 	l.lg.Out = out
+	l.lg.Formatter = formatter(format, out)
 }
 
 // WithField implements logrus WithField.
@@ -312,36 +382,28 @@ func (l Logger) Panicln(args ...interface{}) {
 	l.lg.WithFields(getInfo()).Panicln(args...)
 }
 
-// Log implements logrus Panicln.
+// Log writes msg at given level with the error, when not nil, and the fields.
 func (l Logger) Log(level Level, msg string, err error, fields Fields) {
-	if l.DebugMode {
-		switch level {
-		case PanicLevel:
-			l.WithFields(fields).WithError(err).Panic(msg)
-		case FatalLevel:
-			l.WithFields(fields).WithError(err).Fatal(msg)
-		case ErrorLevel:
-			l.WithFields(fields).WithError(err).Error(msg)
-		case WarnLevel:
-			l.WithFields(fields).WithError(err).Warn(msg)
-		case InfoLevel:
-			l.WithFields(fields).WithError(err).Info(msg)
-		case DebugLevel:
-			l.WithFields(fields).WithError(err).Debug(msg)
-		}
-	} else {
-		switch level {
-		case PanicLevel:
-			l.Panic(msg)
-		case FatalLevel:
-			l.Fatal(msg)
-		case ErrorLevel:
-			l.Error(msg)
-		case WarnLevel:
-			l.Warn(msg)
-		case InfoLevel:
-			l.Info(msg)
-		}
+	// Point at the caller of Log, not at Log itself
+	_, path, line, _ := runtime.Caller(1)
+	e := l.lg.WithField("-FILE", trimFile(path, line)).WithFields(log.Fields(fields))
+	if err != nil {
+		e = e.WithError(err)
+	}
+
+	switch level {
+	case PanicLevel:
+		e.Panic(msg)
+	case FatalLevel:
+		e.Fatal(msg)
+	case ErrorLevel:
+		e.Error(msg)
+	case WarnLevel:
+		e.Warn(msg)
+	case InfoLevel:
+		e.Info(msg)
+	case DebugLevel:
+		e.Debug(msg)
 	}
 }
 
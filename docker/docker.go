@@ -0,0 +1,201 @@
+// Package docker names the images and containers shot creates for a branch, and finds them on targets
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dwarvesf/shot/config"
+	"github.com/dwarvesf/shot/git"
+)
+
+// Labels attached to every image and container built by shot
+const (
+	LabelProject = "shot.project"
+	LabelRepo    = "shot.repo"
+	LabelBranch  = "shot.branch"
+	LabelSHA     = "shot.sha"
+	LabelBuilt   = "shot.built"
+)
+
+// invalidTagChars matches everything docker does not accept in a tag
+var invalidTagChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// Tag converts a branch name into a valid docker tag
+func Tag(branch string) string {
+	tag := invalidTagChars.ReplaceAllString(branch, "-")
+	tag = strings.TrimLeft(tag, ".-")
+	if len(tag) > 100 {
+		tag = tag[:100]
+	}
+	return tag
+}
+
+// ContainerName returns the name of the container running given branch
+func ContainerName(project, branch string) string {
+	return fmt.Sprintf("%s__%s", strings.Replace(project, "/", "-", -1), strings.Replace(branch, "/", "-", -1))
+}
+
+// Image describes one build of a branch
+type Image struct {
+	Registry  string
+	Project   string
+	Repo      string
+	Branch    string
+	SHA       string
+	Built     time.Time
+	Timestamp bool
+}
+
+// Repository returns the image name without tag, e.g. registry/project.
+// Images which never go through a registry are named after the project only.
+func (i Image) Repository() string {
+	if i.Registry == "" {
+		return i.Project
+	}
+	return fmt.Sprintf("%s/%s", i.Registry, i.Project)
+}
+
+// BranchRef returns the moving reference which always points to the latest build of the branch
+func (i Image) BranchRef() string {
+	return fmt.Sprintf("%s:%s", i.Repository(), Tag(i.Branch))
+}
+
+// Ref returns the immutable reference of this build, e.g. registry/project:branch-1a2b3c4
+func (i Image) Ref() string {
+	tag := Tag(i.Branch)
+	if i.SHA != "" {
+		tag += "-" + git.Short(i.SHA)
+	}
+	if i.Timestamp {
+		tag += "-" + i.Built.UTC().Format("20060102150405")
+	}
+	return fmt.Sprintf("%s:%s", i.Repository(), tag)
+}
+
+// Labels returns the metadata recorded on the image and its containers
+func (i Image) Labels() map[string]string {
+	labels := map[string]string{
+		LabelProject: i.Project,
+		LabelBranch:  i.Branch,
+		LabelSHA:     i.SHA,
+		LabelBuilt:   i.Built.UTC().Format(time.RFC3339),
+	}
+	if i.Repo != "" {
+		labels[LabelRepo] = i.Repo
+	}
+	return labels
+}
+
+// LabelArgs renders labels as `--label key=value` arguments, sorted by key
+func LabelArgs(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	args := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		args = append(args, "--label", fmt.Sprintf("%s=%s", k, labels[k]))
+	}
+	return args
+}
+
+// templateData is what build option templates can refer to, e.g. {{.ShortSHA}}
+type templateData struct {
+	Project  string
+	Branch   string
+	Tag      string
+	SHA      string
+	ShortSHA string
+}
+
+// Expand renders s as a text/template with the branch and commit of the image
+func (i Image) Expand(s string) (string, error) {
+	t, err := template.New("").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = t.Execute(&buf, templateData{
+		Project:  i.Project,
+		Branch:   i.Branch,
+		Tag:      Tag(i.Branch),
+		SHA:      i.SHA,
+		ShortSHA: git.Short(i.SHA),
+	})
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// BuildArgs returns the `docker build` command line for the image, dir is the root of the checkout.
+// Dockerfile and context in the build options are relative to dir.
+func BuildArgs(i Image, b config.Build, dir string) ([]string, error) {
+	args := []string{"docker", "build", "-t", i.Ref(), "-t", i.BranchRef()}
+
+	if b.Dockerfile != "" {
+		args = append(args, "-f", filepath.Join(dir, b.Dockerfile))
+	}
+	if b.Target != "" {
+		args = append(args, "--target", b.Target)
+	}
+	if b.Platform != "" {
+		args = append(args, "--platform", b.Platform)
+	}
+
+	keys := make([]string, 0, len(b.Args))
+	for k := range b.Args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, err := i.Expand(b.Args[k])
+		if err != nil {
+			return nil, fmt.Errorf("build arg %s: %v", k, err)
+		}
+		args = append(args, "--build-arg", fmt.Sprintf("%s=%s", k, v))
+	}
+
+	// Secrets are only named, docker reads their values from the environment
+	for _, k := range b.EnvArgs {
+		if _, ok := os.LookupEnv(k); !ok {
+			return nil, fmt.Errorf("build arg %s: environment variable is not set", k)
+		}
+		args = append(args, "--build-arg", k)
+	}
+
+	for _, c := range b.CacheFrom {
+		v, err := i.Expand(c)
+		if err != nil {
+			return nil, fmt.Errorf("cache_from %s: %v", c, err)
+		}
+		args = append(args, "--cache-from", v)
+	}
+
+	labels := map[string]string{}
+	for k, v := range b.Labels {
+		v, err := i.Expand(v)
+		if err != nil {
+			return nil, fmt.Errorf("label %s: %v", k, err)
+		}
+		labels[k] = v
+	}
+	// shot's own labels cannot be overridden
+	for k, v := range i.Labels() {
+		labels[k] = v
+	}
+	args = append(args, LabelArgs(labels)...)
+
+	return append(args, filepath.Join(dir, b.Context)), nil
+}
@@ -0,0 +1,166 @@
+package docker
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dwarvesf/shot/ssh"
+	"github.com/dwarvesf/shot/utils"
+)
+
+// Container is a branch environment found on a target
+type Container struct {
+	Name   string
+	Branch string
+	SHA    string
+	Image  string
+	Status string
+	Ports  string
+	// Built is when the image was built, or the container created for those shot did not label
+	Built time.Time
+}
+
+// ListContainers returns the containers of the project on the target. Branch is empty
+// for containers created before shot labelled them.
+func ListContainers(project string, c ssh.Credential) ([]Container, error) {
+	prefix := ContainerName(project, "")
+	format := fmt.Sprintf(`{{.Names}}|{{.Label "%s"}}|{{.Label "%s"}}|{{.Label "%s"}}|{{.CreatedAt}}|{{.Image}}|{{.Status}}|{{.Ports}}`,
+		LabelBranch, LabelSHA, LabelBuilt)
+	res, err := ssh.Run(fmt.Sprintf("docker ps -a --filter name=%s --format %s", utils.ShellQuote(prefix), utils.ShellQuote(format)), c)
+	if err != nil {
+		return nil, err
+	}
+
+	var containers []Container
+	for _, line := range strings.Split(res, "\n") {
+		f := strings.Split(strings.TrimSpace(line), "|")
+		// The name filter matches substrings, keep exact prefixes only
+		if len(f) != 8 || !strings.HasPrefix(f[0], prefix) {
+			continue
+		}
+		built, err := time.Parse(time.RFC3339, f[3])
+		if err != nil {
+			built, _ = time.Parse("2006-01-02 15:04:05 -0700 MST", f[4])
+		}
+		containers = append(containers, Container{
+			Name:   f[0],
+			Branch: f[1],
+			SHA:    f[2],
+			Image:  f[5],
+			Status: f[6],
+			Ports:  f[7],
+			Built:  built,
+		})
+	}
+	return containers, nil
+}
+
+// ImageSummary is a build of the project found on a target
+type ImageSummary struct {
+	ID      string
+	Branch  string
+	Created time.Time
+	Size    int64
+	Tags    []string
+}
+
+// imageFormat prints the fields of an image as parsed by ListImages
+var imageFormat = fmt.Sprintf(`{{.Id}}|{{index .Config.Labels "%s"}}|{{.Created}}|{{.Size}}|{{join .RepoTags ","}}`, LabelBranch)
+
+// ListImages returns the images of the project on the target, found by their labels
+func ListImages(project string, c ssh.Credential) ([]ImageSummary, error) {
+	cmd := fmt.Sprintf("docker images -q --no-trunc --filter label=%s | sort -u | xargs -r docker image inspect --format %s",
+		utils.ShellQuote(LabelProject+"="+project), utils.ShellQuote(imageFormat))
+	res, err := ssh.Run(cmd, c)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []ImageSummary
+	for _, line := range strings.Split(res, "\n") {
+		f := strings.Split(strings.TrimSpace(line), "|")
+		if len(f) != 5 {
+			continue
+		}
+		created, _ := time.Parse(time.RFC3339Nano, f[2])
+		size, _ := strconv.ParseInt(f[3], 10, 64)
+		var tags []string
+		if f[4] != "" {
+			tags = strings.Split(f[4], ",")
+		}
+		images = append(images, ImageSummary{ID: f[0], Branch: f[1], Created: created, Size: size, Tags: tags})
+	}
+	return images, nil
+}
+
+// PruneImages removes the images of the branch, or of every branch when it is empty, except
+// the keep most recent ones and those containers still use. It returns the removed images.
+func PruneImages(project string, c ssh.Credential, branch string, keep int) ([]ImageSummary, error) {
+	images, err := ListImages(project, c)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := ListContainers(project, c)
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]bool{}
+	for _, ct := range containers {
+		used[ct.Image] = true
+	}
+
+	sort.Slice(images, func(i, j int) bool { return images[i].Created.After(images[j].Created) })
+	kept := map[string]int{}
+	var removed []ImageSummary
+	var failed []string
+	var firstErr error
+	for _, img := range images {
+		if branch != "" && img.Branch != branch {
+			continue
+		}
+		// Containers show their image by reference, or by short ID once the tag moved on
+		id := strings.TrimPrefix(img.ID, "sha256:")
+		if len(id) > 12 {
+			id = id[:12]
+		}
+		inUse := used[img.ID] || used[id]
+		for _, t := range img.Tags {
+			inUse = inUse || used[t]
+		}
+		if inUse || kept[img.Branch] < keep {
+			kept[img.Branch]++
+			continue
+		}
+
+		// Removing the tags deletes the image once it has none left, untagged images go by ID
+		refs := img.Tags
+		if len(refs) == 0 {
+			refs = []string{img.ID}
+		}
+		// A failed removal leaves the image on the disk, it is not counted as removed
+		if _, err := ssh.Run("docker rmi "+utils.ShellJoin(refs), c); err != nil {
+			failed = append(failed, refs[0])
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		removed = append(removed, img)
+	}
+	if firstErr != nil {
+		return removed, fmt.Errorf("cannot remove %d image(s) %s: %v", len(failed), strings.Join(failed, ", "), firstErr)
+	}
+	return removed, nil
+}
+
+// FreeSpace returns the bytes available on the disk docker stores its images on
+func FreeSpace(c ssh.Credential) (int64, error) {
+	res, err := ssh.Run(`df -P -B1 "$(docker info -f '{{.DockerRootDir}}')" | awk 'NR==2 {print $4}'`, c)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(res), 10, 64)
+}
@@ -0,0 +1,38 @@
+package notify
+
+import (
+	"fmt"
+
+	"github.com/dwarvesf/shot/config"
+	"github.com/dwarvesf/shot/utils"
+)
+
+// chat posts events to an incoming webhook of a chat service, e.g. Slack
+type chat struct {
+	// name refers to the webhook by its position, its URL is a secret
+	name    string
+	webhook string
+	// message renders the event in the format of the service
+	message func(e Event) map[string]interface{}
+}
+
+// chats returns a notifier for every channel of the chat service
+func chats(service string, channels []config.Channel, message func(e Event) map[string]interface{}) []Notifier {
+	var n []Notifier
+	for i, c := range channels {
+		n = append(n, quiet(c.Only, &chat{name: fmt.Sprintf("%s channels[%d]", service, i), webhook: c.URL, message: message}))
+	}
+	return n
+}
+
+func (c *chat) Name() string {
+	return c.name
+}
+
+func (c *chat) Notify(e Event) error {
+	if utils.DryRun {
+		utils.PrintPlan(c.name, e.Text())
+		return nil
+	}
+	return utils.PostJSON(c.webhook, c.message(e))
+}
@@ -0,0 +1,48 @@
+package notify
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dwarvesf/shot/config"
+)
+
+func init() {
+	register(func(cfg *config.Config) []Notifier {
+		if !cfg.Notification.Discord.Enable {
+			return nil
+		}
+		return chats("discord", cfg.Notification.Discord.Channels, discordMessage)
+	})
+}
+
+// discordMessage renders the event as an embed
+func discordMessage(e Event) map[string]interface{} {
+	var fields []map[string]interface{}
+	for _, f := range e.facts() {
+		v := f.Value
+		if f.Code {
+			v = "`" + v + "`"
+		}
+		fields = append(fields, map[string]interface{}{"name": f.Name, "value": truncate(v, 1000), "inline": true})
+	}
+
+	color, _ := strconv.ParseInt(strings.TrimPrefix(colors[e.Kind], "#"), 16, 32)
+	embed := map[string]interface{}{
+		"title":     truncate(e.Subject(), 250),
+		"color":     color,
+		"fields":    fields,
+		"timestamp": e.Time.UTC().Format(time.RFC3339),
+	}
+	if e.URL != "" {
+		embed["url"] = e.URL
+	}
+	if e.Err != nil {
+		embed["description"] = "```" + truncate(e.Err.Error(), 4000) + "```"
+	}
+
+	return map[string]interface{}{
+		"embeds": []map[string]interface{}{embed},
+	}
+}
@@ -0,0 +1,172 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/dwarvesf/shot/config"
+	"github.com/dwarvesf/shot/git"
+	"github.com/dwarvesf/shot/utils"
+)
+
+func init() {
+	register(func(cfg *config.Config) []Notifier {
+		if !cfg.Notification.Email.Enable {
+			return nil
+		}
+		// Addresses without a filter of their own get a single email together
+		all := cfg.Notification.Email.Only
+		var to []string
+		var n []Notifier
+		for i, r := range cfg.Notification.Email.Recipients {
+			if len(r.Only.Events) == 0 && len(r.Only.Branches) == 0 && len(r.Only.Targets) == 0 {
+				to = append(to, r.To...)
+				continue
+			}
+			f := config.Filter{Events: r.Only.Events, Branches: r.Only.Branches, Targets: r.Only.Targets}
+			if len(f.Events) == 0 {
+				f.Events = all.Events
+			}
+			if len(f.Branches) == 0 {
+				f.Branches = all.Branches
+			}
+			if len(f.Targets) == 0 {
+				f.Targets = all.Targets
+			}
+			n = append(n, quiet(f, &email{name: fmt.Sprintf("mail recipients[%d]", i), to: r.To, cfg: cfg}))
+		}
+		if len(to) != 0 {
+			n = append([]Notifier{quiet(all, &email{name: "mail", to: to, cfg: cfg})}, n...)
+		}
+		return n
+	})
+}
+
+// Default templates of the emails
+const (
+	DefaultSubject = `{{.Subject}}`
+	DefaultText    = `{{.Text}}
+{{if .Commit}}
+Commit:   {{.ShortSHA}}{{with .Author}} by {{.}}{{end}}{{end}}{{if .URL}}
+URL:      {{.URL}}{{end}}{{if .Duration}}
+Duration: {{.Duration}}{{end}}{{if .Logs}}
+
+Logs:
+{{.Logs}}{{end}}
+`
+	DefaultHTML = `<!DOCTYPE html>
+<html>
+<body style="font-family: -apple-system, Helvetica, Arial, sans-serif; color: #1d1c1d">
+<div style="border-left: 4px solid {{.Color}}; padding: 4px 12px">
+<h2 style="margin: 0 0 12px">{{.Subject}}</h2>
+<table cellpadding="4">
+<tr><th align="left">Project</th><td>{{.Project}}</td></tr>
+<tr><th align="left">Branch</th><td>{{.Branch}}</td></tr>
+{{- if .Commit}}
+<tr><th align="left">Commit</th><td><code>{{.ShortSHA}}</code>{{with .Author}} by {{.}}{{end}}</td></tr>
+{{- end}}
+<tr><th align="left">Target</th><td>{{.Target}}{{if .Port}}:{{.Port}}{{end}}</td></tr>
+{{- if .URL}}
+<tr><th align="left">URL</th><td><a href="{{.URL}}">{{.URL}}</a></td></tr>
+{{- end}}
+{{- if .Duration}}
+<tr><th align="left">Duration</th><td>{{.Duration}}</td></tr>
+{{- end}}
+{{- if .Step}}
+<tr><th align="left">Step</th><td>{{.Step}}</td></tr>
+{{- end}}
+{{- if .Reason}}
+<tr><th align="left">Reason</th><td>{{.Reason}}</td></tr>
+{{- end}}
+</table>
+{{- if .Err}}
+<h3>Error</h3>
+<pre style="background: #f8f8f8; padding: 8px; white-space: pre-wrap">{{.Err}}</pre>
+{{- end}}
+{{- if .Logs}}
+<h3>Logs</h3>
+<pre style="background: #f8f8f8; padding: 8px; white-space: pre-wrap">{{.Logs}}</pre>
+{{- end}}
+</div>
+</body>
+</html>
+`
+)
+
+// mailData is what email templates are given: the event and a few helpers
+type mailData struct {
+	Event
+	// Commit is the full hash of the commit, ShortSHA its abbreviation
+	Commit   string
+	ShortSHA string
+	// Color is the colour of the kind of event, e.g. red for failures
+	Color string
+}
+
+// email mails events to a group of recipients at once through the configured SMTP server
+type email struct {
+	name string
+	to   []string
+	cfg  *config.Config
+}
+
+func (m *email) Name() string {
+	return m.name
+}
+
+func (m *email) Notify(e Event) error {
+	tpl := m.cfg.Notification.Email.Templates
+	data := mailData{Event: e, Commit: e.SHA, ShortSHA: git.Short(e.SHA), Color: colors[e.Kind]}
+	if data.Duration != 0 {
+		data.Duration = data.Duration.Round(time.Second)
+	}
+
+	subject, err := renderText("subject", or(tpl.Subject, DefaultSubject), data)
+	if err != nil {
+		return err
+	}
+	// Headers are a single line
+	subject = strings.Join(strings.Fields(subject), " ")
+	text, err := renderText("text", or(tpl.Text, DefaultText), data)
+	if err != nil {
+		return err
+	}
+	var html string
+	if tpl.HTML != "-" {
+		t, err := htmltemplate.New("html").Parse(or(tpl.HTML, DefaultHTML))
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err = t.Execute(&buf, data); err != nil {
+			return err
+		}
+		html = buf.String()
+	}
+
+	return utils.SendMail(m.to, subject, text, html, m.cfg)
+}
+
+func renderText(name, text string, data interface{}) (string, error) {
+	t, err := texttemplate.New(name).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// or returns s, or def when s is empty
+func or(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
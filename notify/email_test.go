@@ -0,0 +1,97 @@
+package notify
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dwarvesf/shot/config"
+)
+
+func TestEmailRecipients(t *testing.T) {
+	quietEvents := []string{"deploy_succeeded", "deploy_failed", "down", "rollback"}
+
+	// group is what an email notifier of the configuration sends to, and when
+	type group struct {
+		name string
+		to   []string
+		only config.Filter
+	}
+	tests := []struct {
+		name       string
+		only       config.Filter
+		recipients []config.Recipient
+		want       []group
+	}{
+		{
+			name: "plain addresses get one email",
+			recipients: []config.Recipient{
+				{To: []string{"a@x.com"}},
+				{To: []string{"b@x.com", "c@x.com"}},
+			},
+			want: []group{
+				{"mail", []string{"a@x.com", "b@x.com", "c@x.com"}, config.Filter{Events: quietEvents}},
+			},
+		},
+		{
+			name: "plain addresses use the filter of email",
+			only: config.Filter{Branches: []string{"master"}},
+			recipients: []config.Recipient{
+				{To: []string{"a@x.com"}},
+			},
+			want: []group{
+				{"mail", []string{"a@x.com"}, config.Filter{Events: quietEvents, Branches: []string{"master"}}},
+			},
+		},
+		{
+			name: "filtered recipients get their own email",
+			recipients: []config.Recipient{
+				{To: []string{"a@x.com"}},
+				{To: []string{"ops@x.com"}, Only: config.Filter{Events: []string{"deploy_failed"}}},
+			},
+			want: []group{
+				{"mail", []string{"a@x.com"}, config.Filter{Events: quietEvents}},
+				{"mail recipients[1]", []string{"ops@x.com"}, config.Filter{Events: []string{"deploy_failed"}}},
+			},
+		},
+		{
+			name: "lists not set fall back to those of email",
+			only: config.Filter{Events: []string{"deploy_started"}, Branches: []string{"master"}, Targets: []string{"10.0.0.1"}},
+			recipients: []config.Recipient{
+				{To: []string{"qa@x.com"}, Only: config.Filter{Branches: []string{"release/*"}}},
+				{To: []string{"ops@x.com"}, Only: config.Filter{Events: []string{"down"}, Targets: []string{"10.0.0.2"}}},
+			},
+			want: []group{
+				{"mail recipients[0]", []string{"qa@x.com"}, config.Filter{Events: []string{"deploy_started"}, Branches: []string{"release/*"}, Targets: []string{"10.0.0.1"}}},
+				{"mail recipients[1]", []string{"ops@x.com"}, config.Filter{Events: []string{"down"}, Branches: []string{"master"}, Targets: []string{"10.0.0.2"}}},
+			},
+		},
+		{
+			name: "filtered recipients without events stay quiet",
+			recipients: []config.Recipient{
+				{To: []string{"qa@x.com"}, Only: config.Filter{Branches: []string{"release/*"}}},
+			},
+			want: []group{
+				{"mail recipients[0]", []string{"qa@x.com"}, config.Filter{Events: quietEvents, Branches: []string{"release/*"}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		cfg := &config.Config{}
+		cfg.Notification.Email.Enable = true
+		cfg.Notification.Email.Only = tt.only
+		cfg.Notification.Email.Recipients = tt.recipients
+
+		var got []group
+		for _, n := range New(cfg) {
+			f, ok := n.(*filtered)
+			if !ok {
+				t.Fatalf("%s: %s is not filtered", tt.name, n.Name())
+			}
+			m := f.Notifier.(*email)
+			got = append(got, group{m.name, m.to, f.only})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: notifiers %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dwarvesf/shot/config"
+	"github.com/dwarvesf/shot/git"
+	"github.com/dwarvesf/shot/utils"
+)
+
+// commentMarker is hidden in the comments shot writes so it finds them again,
+// there is one comment per target
+func commentMarker(target string) string {
+	return fmt.Sprintf("<!-- shot:%s -->", target)
+}
+
+// commentBody returns the comment about the environment of the event, or an empty string
+// when the event does not change it
+func commentBody(e Event) string {
+	var body string
+	switch e.Kind {
+	case DeploySucceeded:
+		body = fmt.Sprintf(":rocket: `%s` is deployed to %s at commit %s", e.Branch, e.URL, git.Short(e.SHA))
+	case Down:
+		body = fmt.Sprintf(":wastebasket: The environment of `%s` on %s was taken down", e.Branch, e.Target)
+		if e.Reason != "" {
+			body += ", " + e.Reason
+		}
+	default:
+		return ""
+	}
+	return commentMarker(e.Target) + "\n" + body
+}
+
+// forgeClient calls the JSON API of GitHub or GitLab
+type forgeClient struct {
+	base    string
+	headers map[string]string
+}
+
+// newForgeClient reads the token of the forge from the environment
+func newForgeClient(f config.Forge, defaultAPI, defaultTokenEnv string, auth func(token string) map[string]string) (*forgeClient, error) {
+	env := f.TokenEnv
+	if env == "" {
+		env = defaultTokenEnv
+	}
+	token := os.Getenv(env)
+	if token == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", env)
+	}
+	base := f.APIURL
+	if base == "" {
+		base = defaultAPI
+	}
+	return &forgeClient{base: strings.TrimRight(base, "/"), headers: auth(token)}, nil
+}
+
+// do sends in as JSON, when not nil, and decodes the response into out, when not nil.
+// Responses other than 2xx are errors.
+func (c *forgeClient) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, path, res.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// forgeAPI is what differs between forges: how to authenticate, set a commit status
+// and find the comments of the pull or merge request of a branch
+type forgeAPI interface {
+	client(f config.Forge) (*forgeClient, error)
+	// status sets the commit status of the target to state
+	status(c *forgeClient, repo, state string, e Event) error
+	// thread returns the comments of the open request of the branch, nil when there is none
+	thread(c *forgeClient, repo, branch string) (*thread, error)
+}
+
+// thread is where the comments of a pull or merge request are listed, posted and edited
+type thread struct {
+	// comments lists and posts the comments
+	comments string
+	// edit returns where the comment with given ID is updated, with editMethod
+	edit       func(id int64) string
+	editMethod string
+}
+
+// forge sets a commit status per target and comments the environment on the request of the branch
+type forge struct {
+	config.Forge
+	name string
+	// states are the commit status states of the events, events without one only update the comment
+	states map[Kind]string
+	api    forgeAPI
+}
+
+func (f *forge) Name() string {
+	return f.name
+}
+
+func (f *forge) Notify(e Event) error {
+	state, ok := f.states[e.Kind]
+	// Failures before the commit is known have nothing to be attached to
+	if !ok || e.SHA == "" {
+		return nil
+	}
+	repo := repoOf(f.Forge)
+	body := commentBody(e)
+	if utils.DryRun {
+		if state != "" {
+			utils.PrintPlan(f.name, fmt.Sprintf("status %s on %s@%s", state, repo, e.SHA))
+		}
+		if f.Comment && body != "" {
+			utils.PrintPlan(f.name, fmt.Sprintf("comment on the pull or merge request of %s: %s", e.Branch, strings.TrimPrefix(body, commentMarker(e.Target)+"\n")))
+		}
+		return nil
+	}
+
+	c, err := f.api.client(f.Forge)
+	if err != nil {
+		return err
+	}
+	if state != "" {
+		if err = f.api.status(c, repo, state, e); err != nil {
+			return err
+		}
+	}
+
+	if !f.Comment || body == "" {
+		return nil
+	}
+	t, err := f.api.thread(c, repo, e.Branch)
+	if err != nil || t == nil {
+		return err
+	}
+	return c.comment(t, e, body)
+}
+
+// comment writes or updates the comment of the target in the thread
+func (c *forgeClient) comment(t *thread, e Event, body string) error {
+	var comments []struct {
+		ID   int64  `json:"id"`
+		Body string `json:"body"`
+	}
+	if err := c.do("GET", t.comments+"?per_page=100", nil, &comments); err != nil {
+		return err
+	}
+	for _, cm := range comments {
+		if strings.HasPrefix(cm.Body, commentMarker(e.Target)) {
+			return c.do(t.editMethod, t.edit(cm.ID), map[string]string{"body": body}, nil)
+		}
+	}
+	// There is nothing to update about an environment never announced
+	if e.Kind == Down {
+		return nil
+	}
+	return c.do("POST", t.comments, map[string]string{"body": body}, nil)
+}
+
+// repoOf returns the path of the repository set for the forge, or the one of the origin remote
+func repoOf(f config.Forge) string {
+	if f.Repo != "" {
+		return f.Repo
+	}
+	return git.RepoPath(git.RemoteURL())
+}
@@ -0,0 +1,70 @@
+package notify
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/dwarvesf/shot/config"
+)
+
+func init() {
+	register(func(cfg *config.Config) []Notifier {
+		if !cfg.Notification.GitHub.Enable {
+			return nil
+		}
+		return []Notifier{only(cfg.Notification.GitHub.Only, &forge{Forge: cfg.Notification.GitHub, name: "github", states: githubStates, api: githubAPI{}})}
+	})
+}
+
+// githubStates are the commit status states of the events. Down only updates the comment,
+// the status keeps telling how the commit deployed.
+var githubStates = map[Kind]string{
+	DeployStarted:   "pending",
+	DeploySucceeded: "success",
+	DeployFailed:    "failure",
+	Down:            "",
+}
+
+// githubAPI sets statuses and comments on pull requests of GitHub
+type githubAPI struct{}
+
+func (githubAPI) client(f config.Forge) (*forgeClient, error) {
+	return newForgeClient(f, "https://api.github.com", "GITHUB_TOKEN", func(token string) map[string]string {
+		return map[string]string{"Authorization": "token " + token, "Accept": "application/vnd.github+json"}
+	})
+}
+
+func (githubAPI) status(c *forgeClient, repo, state string, e Event) error {
+	status := map[string]string{
+		"state":       state,
+		"context":     "shot/" + e.Target,
+		"description": truncate(e.Text(), 137),
+	}
+	if e.Kind != Down && e.URL != "" {
+		status["target_url"] = e.URL
+	}
+	return c.do("POST", fmt.Sprintf("/repos/%s/statuses/%s", repo, e.SHA), status, nil)
+}
+
+func (githubAPI) thread(c *forgeClient, repo, branch string) (*thread, error) {
+	owner := strings.Split(repo, "/")[0]
+	var pulls []struct {
+		Number int `json:"number"`
+	}
+	q := url.Values{"state": {"open"}, "head": {owner + ":" + branch}}
+	if err := c.do("GET", fmt.Sprintf("/repos/%s/pulls?%s", repo, q.Encode()), nil, &pulls); err != nil {
+		return nil, err
+	}
+	if len(pulls) == 0 {
+		return nil, nil
+	}
+
+	return &thread{
+		comments: fmt.Sprintf("/repos/%s/issues/%d/comments", repo, pulls[0].Number),
+		edit: func(id int64) string {
+			return fmt.Sprintf("/repos/%s/issues/comments/%d", repo, id)
+		},
+		editMethod: "PATCH",
+	}, nil
+}
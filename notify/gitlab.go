@@ -0,0 +1,78 @@
+package notify
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/dwarvesf/shot/config"
+)
+
+func init() {
+	register(func(cfg *config.Config) []Notifier {
+		if !cfg.Notification.GitLab.Enable {
+			return nil
+		}
+		return []Notifier{only(cfg.Notification.GitLab.Only, &forge{Forge: cfg.Notification.GitLab, name: "gitlab", states: gitlabStates, api: gitlabAPI{}})}
+	})
+}
+
+// gitlabStates are the commit status states of the events. Down only updates the note:
+// GitLab cannot move a status from success to canceled.
+var gitlabStates = map[Kind]string{
+	DeployStarted:   "running",
+	DeploySucceeded: "success",
+	DeployFailed:    "failed",
+	Down:            "",
+}
+
+// gitlabAPI sets statuses and notes on merge requests of GitLab
+type gitlabAPI struct{}
+
+func (gitlabAPI) client(f config.Forge) (*forgeClient, error) {
+	return newForgeClient(f, "https://gitlab.com/api/v4", "GITLAB_TOKEN", func(token string) map[string]string {
+		return map[string]string{"PRIVATE-TOKEN": token}
+	})
+}
+
+func (gitlabAPI) status(c *forgeClient, repo, state string, e Event) error {
+	status := map[string]string{
+		"state":       state,
+		"name":        "shot/" + e.Target,
+		"ref":         e.Branch,
+		"description": truncate(e.Text(), 255),
+	}
+	if e.URL != "" {
+		status["target_url"] = e.URL
+	}
+	err := c.do("POST", fmt.Sprintf("/projects/%s/statuses/%s", url.PathEscape(repo), e.SHA), status, nil)
+	// A commit deployed again may have a final status GitLab will not move, e.g. from
+	// success to running. The status stays as it is, the note is still updated.
+	if err != nil && strings.Contains(err.Error(), "Cannot transition status") {
+		return nil
+	}
+	return err
+}
+
+func (gitlabAPI) thread(c *forgeClient, repo, branch string) (*thread, error) {
+	project := "/projects/" + url.PathEscape(repo)
+	var mrs []struct {
+		IID int `json:"iid"`
+	}
+	q := url.Values{"state": {"opened"}, "source_branch": {branch}}
+	if err := c.do("GET", fmt.Sprintf("%s/merge_requests?%s", project, q.Encode()), nil, &mrs); err != nil {
+		return nil, err
+	}
+	if len(mrs) == 0 {
+		return nil, nil
+	}
+
+	notes := fmt.Sprintf("%s/merge_requests/%d/notes", project, mrs[0].IID)
+	return &thread{
+		comments: notes,
+		edit: func(id int64) string {
+			return fmt.Sprintf("%s/%d", notes, id)
+		},
+		editMethod: "PUT",
+	}, nil
+}
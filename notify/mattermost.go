@@ -0,0 +1,50 @@
+package notify
+
+import (
+	"github.com/dwarvesf/shot/config"
+)
+
+func init() {
+	register(func(cfg *config.Config) []Notifier {
+		m := cfg.Notification.Mattermost
+		if !m.Enable {
+			return nil
+		}
+		return chats("mattermost", m.Channels, func(e Event) map[string]interface{} {
+			return mattermostMessage(e, m.Username)
+		})
+	})
+}
+
+// mattermostMessage renders the event as a message attachment, the Slack format Mattermost understands
+func mattermostMessage(e Event, username string) map[string]interface{} {
+	var fields []map[string]interface{}
+	for _, f := range e.facts() {
+		v := f.Value
+		if f.Code {
+			v = "`" + v + "`"
+		}
+		fields = append(fields, map[string]interface{}{"title": f.Name, "value": v, "short": true})
+	}
+
+	attachment := map[string]interface{}{
+		"fallback": e.Text(),
+		"color":    colors[e.Kind],
+		"title":    e.Subject(),
+		"fields":   fields,
+	}
+	if e.URL != "" {
+		attachment["title_link"] = e.URL
+	}
+	if e.Err != nil {
+		attachment["text"] = "```\n" + truncate(e.Err.Error(), 3000) + "\n```"
+	}
+
+	msg := map[string]interface{}{
+		"attachments": []map[string]interface{}{attachment},
+	}
+	if username != "" {
+		msg["username"] = username
+	}
+	return msg
+}
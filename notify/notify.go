@@ -0,0 +1,295 @@
+// Package notify tells people about what shot does, over the channels enabled in the configuration
+package notify
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dwarvesf/shot/config"
+	"github.com/dwarvesf/shot/git"
+)
+
+// Kind is what happened
+type Kind string
+
+// Kinds of events
+const (
+	DeployStarted   Kind = config.EventDeployStarted
+	DeploySucceeded Kind = config.EventDeploySucceeded
+	DeployFailed    Kind = config.EventDeployFailed
+	Down            Kind = config.EventDown
+	Rollback        Kind = config.EventRollback
+)
+
+// Event is something which happened to a branch on a target
+type Event struct {
+	Kind    Kind
+	Project string
+	Branch  string
+	SHA     string
+	// Image is the reference of the image deployed
+	Image string
+	// Author is who made the commit
+	Author string
+	Target string
+	// Port is where the branch is published on the target, 0 when unknown
+	Port int
+	// URL is where the deployed branch can be reached
+	URL string
+	// Duration is how long the deploy took
+	Duration time.Duration
+	// Reason tells why, e.g. why a branch was taken down
+	Reason string
+	// Step is what was being done when the deploy failed, and Err why
+	Step string
+	Err  error
+	// Logs is the end of the output of the container, when it failed to start
+	Logs string
+	Time time.Time
+}
+
+// Subject returns a one line summary of the event, e.g. for mail subjects
+func (e Event) Subject() string {
+	switch e.Kind {
+	case DeployStarted:
+		return fmt.Sprintf("Deploying %s to server with PR %s", e.Project, e.Branch)
+	case DeploySucceeded:
+		return fmt.Sprintf("Deployed %s to server with PR %s", e.Project, e.Branch)
+	case DeployFailed:
+		return fmt.Sprintf("Failed to deploy %s to server with PR %s", e.Project, e.Branch)
+	}
+	return e.Text()
+}
+
+// Status returns the outcome of the event in a word: pending, success, failure, removed or rolled_back
+func (e Event) Status() string {
+	switch e.Kind {
+	case DeployStarted:
+		return "pending"
+	case DeploySucceeded:
+		return "success"
+	case DeployFailed:
+		return "failure"
+	case Down:
+		return "removed"
+	case Rollback:
+		return "rolled_back"
+	}
+	return string(e.Kind)
+}
+
+// Text returns the message describing the event
+func (e Event) Text() string {
+	ref := fmt.Sprintf("%s:%s", e.Project, e.Branch)
+	if e.SHA != "" {
+		ref += "@" + git.Short(e.SHA)
+	}
+	server := e.Target
+	if e.Port != 0 {
+		server = fmt.Sprintf("%s:%d", e.Target, e.Port)
+	}
+
+	var text string
+	switch e.Kind {
+	case DeployStarted:
+		text = fmt.Sprintf("Deploying (%s) to server %s", ref, server)
+	case DeploySucceeded:
+		text = fmt.Sprintf("Deployed (%s) to server %s", ref, server)
+	case DeployFailed:
+		text = fmt.Sprintf("Failed to deploy (%s) to server %s", ref, server)
+		if e.Step != "" {
+			text += " while " + e.Step
+		}
+		if e.Err != nil {
+			text += ": " + e.Err.Error()
+		}
+	case Down:
+		text = fmt.Sprintf("Shutdown (%s) from server %s", ref, server)
+	case Rollback:
+		text = fmt.Sprintf("Rolled back (%s) on server %s", ref, server)
+	default:
+		text = fmt.Sprintf("%s (%s) on server %s", e.Kind, ref, server)
+	}
+	if e.Reason != "" {
+		text += ", " + e.Reason
+	}
+	return text
+}
+
+// colors tells the kinds of events apart in channels showing a coloured bar
+var colors = map[Kind]string{
+	DeployStarted:   "#439fe0",
+	DeploySucceeded: "#2eb886",
+	DeployFailed:    "#e01e5a",
+	Down:            "#9e9e9e",
+	Rollback:        "#daa038",
+}
+
+// fact is a named detail of an event, shown as a field by rich channels
+type fact struct {
+	Name  string
+	Value string
+	// Link is set for URLs and Code for commit hashes, channels format them their way
+	Link bool
+	Code bool
+}
+
+// facts returns the details of the event which are set, in display order
+func (e Event) facts() []fact {
+	target := e.Target
+	if e.Port != 0 {
+		target = fmt.Sprintf("%s:%d", e.Target, e.Port)
+	}
+	var duration string
+	if e.Duration != 0 {
+		duration = e.Duration.Round(time.Second).String()
+	}
+
+	all := []fact{
+		{Name: "Project", Value: e.Project},
+		{Name: "Branch", Value: e.Branch},
+		{Name: "Commit", Value: git.Short(e.SHA), Code: true},
+		{Name: "Author", Value: e.Author},
+		{Name: "Target", Value: target},
+		{Name: "URL", Value: e.URL, Link: true},
+		{Name: "Duration", Value: duration},
+		{Name: "Step", Value: e.Step},
+		{Name: "Reason", Value: e.Reason},
+	}
+	var facts []fact
+	for _, f := range all {
+		if f.Value != "" {
+			facts = append(facts, f)
+		}
+	}
+	return facts
+}
+
+// truncate shortens s to at most n bytes, channels limit the length of texts
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "…"
+}
+
+// Notifier sends events over one channel, e.g. a Slack webhook
+type Notifier interface {
+	// Name identifies the channel in errors, it must not contain secrets
+	Name() string
+	Notify(e Event) error
+}
+
+// filtered only sends the events matching its filter
+type filtered struct {
+	Notifier
+	only config.Filter
+}
+
+// only restricts n to the events matching f, n is returned as is when f is empty
+func only(f config.Filter, n Notifier) Notifier {
+	if len(f.Events) == 0 && len(f.Branches) == 0 && len(f.Targets) == 0 {
+		return n
+	}
+	return &filtered{Notifier: n, only: f}
+}
+
+// quiet restricts n like only does, but deploy_started is sent only when f lists it.
+// People reading the channel would otherwise get two messages for every deploy.
+func quiet(f config.Filter, n Notifier) Notifier {
+	if len(f.Events) == 0 {
+		f.Events = []string{string(DeploySucceeded), string(DeployFailed), string(Down), string(Rollback)}
+	}
+	return only(f, n)
+}
+
+func (f *filtered) Notify(e Event) error {
+	if !Match(f.only, e) {
+		return nil
+	}
+	return f.Notifier.Notify(e)
+}
+
+// Match reports whether the event passes the filter: each list of the filter
+// which is set must have an entry matching the event
+func Match(f config.Filter, e Event) bool {
+	return matchAny(f.Events, string(e.Kind)) && matchAny(f.Branches, e.Branch) && matchAny(f.Targets, e.Target)
+}
+
+// matchAny reports whether one of the patterns matches s, or there are no patterns
+func matchAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// channels create the notifiers of every kind of channel from the configuration,
+// they return none when the channel is disabled
+var channels []func(cfg *config.Config) []Notifier
+
+// register makes a kind of channel available, channels call it from init
+func register(f func(cfg *config.Config) []Notifier) {
+	channels = append(channels, f)
+}
+
+// Notifiers sends events to several channels at once
+type Notifiers []Notifier
+
+// New returns the notifiers of every channel enabled in the configuration
+func New(cfg *config.Config) Notifiers {
+	var n Notifiers
+	for _, f := range channels {
+		n = append(n, f(cfg)...)
+	}
+	return n
+}
+
+// Error is returned when some channels could not be notified
+type Error struct {
+	Failed map[string]error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d notification(s) failed", len(e.Failed))
+}
+
+// Notify sends the event to every notifier concurrently and waits for them
+func (n Notifiers) Notify(e Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	var mu sync.Mutex
+	res := &Error{Failed: map[string]error{}}
+	var wg sync.WaitGroup
+	wg.Add(len(n))
+	for _, v := range n {
+		nt := v
+		go func() {
+			defer wg.Done()
+			if err := nt.Notify(e); err != nil {
+				mu.Lock()
+				res.Failed[nt.Name()] = err
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(res.Failed) != 0 {
+		return res
+	}
+	return nil
+}
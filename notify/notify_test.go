@@ -0,0 +1,99 @@
+package notify
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dwarvesf/shot/config"
+)
+
+// record keeps the events it is sent
+type record struct {
+	got []Event
+}
+
+func (r *record) Name() string { return "record" }
+
+func (r *record) Notify(e Event) error {
+	r.got = append(r.got, e)
+	return nil
+}
+
+func TestMatch(t *testing.T) {
+	e := Event{Kind: DeployFailed, Branch: "feature/login", Target: "10.0.0.1"}
+	tests := []struct {
+		name   string
+		filter config.Filter
+		want   bool
+	}{
+		{"empty filter", config.Filter{}, true},
+		{"event listed", config.Filter{Events: []string{"deploy_succeeded", "deploy_failed"}}, true},
+		{"event not listed", config.Filter{Events: []string{"deploy_succeeded"}}, false},
+		{"branch pattern", config.Filter{Branches: []string{"feature/*"}}, true},
+		{"branch pattern not matching", config.Filter{Branches: []string{"release/*"}}, false},
+		{"target pattern", config.Filter{Targets: []string{"10.0.0.*"}}, true},
+		{"target not matching", config.Filter{Targets: []string{"10.0.0.2"}}, false},
+		{"all lists match", config.Filter{Events: []string{"deploy_failed"}, Branches: []string{"feature/*"}, Targets: []string{"10.0.0.1"}}, true},
+		{"one list does not match", config.Filter{Events: []string{"deploy_failed"}, Branches: []string{"master"}}, false},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.filter, e); got != tt.want {
+			t.Errorf("%s: Match() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOnlyAndQuiet(t *testing.T) {
+	all := []Kind{DeployStarted, DeploySucceeded, DeployFailed, Down, Rollback}
+	tests := []struct {
+		name   string
+		quiet  bool
+		filter config.Filter
+		want   []Kind
+	}{
+		{
+			name: "only without a filter sends everything",
+			want: all,
+		},
+		{
+			name:   "only with events",
+			filter: config.Filter{Events: []string{"deploy_started", "down"}},
+			want:   []Kind{DeployStarted, Down},
+		},
+		{
+			name:  "quiet leaves deploy_started out by default",
+			quiet: true,
+			want:  []Kind{DeploySucceeded, DeployFailed, Down, Rollback},
+		},
+		{
+			name:   "quiet sends deploy_started when listed",
+			quiet:  true,
+			filter: config.Filter{Events: []string{"deploy_started"}},
+			want:   []Kind{DeployStarted},
+		},
+		{
+			name:   "quiet with a branch filter only",
+			quiet:  true,
+			filter: config.Filter{Branches: []string{"master"}},
+			want:   []Kind{DeploySucceeded, DeployFailed, Down, Rollback},
+		},
+	}
+	for _, tt := range tests {
+		r := &record{}
+		n := only(tt.filter, r)
+		if tt.quiet {
+			n = quiet(tt.filter, r)
+		}
+		for _, k := range all {
+			n.Notify(Event{Kind: k, Branch: "master"})
+		}
+
+		var got []Kind
+		for _, e := range r.got {
+			got = append(got, e.Kind)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: sent %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dwarvesf/shot/config"
+)
+
+func init() {
+	register(func(cfg *config.Config) []Notifier {
+		if !cfg.Notification.Slack.Enable {
+			return nil
+		}
+		return chats("slack", cfg.Notification.Slack.Channels, slackMessage)
+	})
+}
+
+// slackMessage renders the event with Block Kit inside a coloured attachment,
+// text is what notifications and clients without blocks show
+func slackMessage(e Event) map[string]interface{} {
+	var fields []map[string]interface{}
+	for _, f := range e.facts() {
+		v := slackEscape(f.Value)
+		switch {
+		case f.Link:
+			v = fmt.Sprintf("<%s|%s>", f.Value, v)
+		case f.Code:
+			v = "`" + v + "`"
+		}
+		fields = append(fields, map[string]interface{}{
+			"type": "mrkdwn",
+			"text": fmt.Sprintf("*%s*\n%s", f.Name, v),
+		})
+	}
+
+	blocks := []map[string]interface{}{
+		{
+			"type": "section",
+			"text": map[string]interface{}{"type": "mrkdwn", "text": "*" + slackEscape(e.Subject()) + "*"},
+		},
+	}
+	// Slack allows at most 10 fields in a section
+	for i := 0; i < len(fields); i += 10 {
+		end := i + 10
+		if end > len(fields) {
+			end = len(fields)
+		}
+		blocks = append(blocks, map[string]interface{}{"type": "section", "fields": fields[i:end]})
+	}
+	if e.Err != nil {
+		blocks = append(blocks, map[string]interface{}{
+			"type": "section",
+			"text": map[string]interface{}{"type": "mrkdwn", "text": "```" + slackEscape(truncate(e.Err.Error(), 2900)) + "```"},
+		})
+	}
+
+	return map[string]interface{}{
+		"text": e.Text(),
+		"attachments": []map[string]interface{}{
+			{"color": colors[e.Kind], "blocks": blocks},
+		},
+	}
+}
+
+// slackEscape escapes the characters Slack gives a meaning to in text
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
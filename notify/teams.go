@@ -0,0 +1,68 @@
+package notify
+
+import (
+	"fmt"
+
+	"github.com/dwarvesf/shot/config"
+)
+
+func init() {
+	register(func(cfg *config.Config) []Notifier {
+		if !cfg.Notification.Teams.Enable {
+			return nil
+		}
+		return chats("teams", cfg.Notification.Teams.Channels, teamsMessage)
+	})
+}
+
+// teamsColors are the colours an Adaptive Card knows, by name
+var teamsColors = map[Kind]string{
+	DeploySucceeded: "Good",
+	DeployFailed:    "Attention",
+	Rollback:        "Warning",
+}
+
+// teamsMessage renders the event as an Adaptive Card
+func teamsMessage(e Event) map[string]interface{} {
+	color := teamsColors[e.Kind]
+	if color == "" {
+		color = "Default"
+	}
+
+	var facts []map[string]interface{}
+	for _, f := range e.facts() {
+		v := f.Value
+		if f.Link {
+			v = fmt.Sprintf("[%s](%s)", f.Value, f.Value)
+		}
+		facts = append(facts, map[string]interface{}{"title": f.Name, "value": v})
+	}
+
+	body := []map[string]interface{}{
+		{"type": "TextBlock", "text": e.Subject(), "weight": "Bolder", "size": "Medium", "color": color, "wrap": true},
+		{"type": "FactSet", "facts": facts},
+	}
+	if e.Err != nil {
+		body = append(body, map[string]interface{}{
+			"type": "TextBlock", "text": truncate(e.Err.Error(), 2000), "fontType": "Monospace", "color": "Attention", "wrap": true,
+		})
+	}
+	card := map[string]interface{}{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body":    body,
+	}
+	if e.URL != "" {
+		card["actions"] = []map[string]interface{}{
+			{"type": "Action.OpenUrl", "title": "Open", "url": e.URL},
+		}
+	}
+
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []map[string]interface{}{
+			{"contentType": "application/vnd.microsoft.card.adaptive", "content": card},
+		},
+	}
+}
@@ -0,0 +1,111 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dwarvesf/shot/config"
+	"github.com/dwarvesf/shot/utils"
+)
+
+// Headers sent along with webhook payloads
+const (
+	HeaderEvent     = "X-Shot-Event"
+	HeaderSignature = "X-Shot-Signature"
+)
+
+func init() {
+	register(func(cfg *config.Config) []Notifier {
+		var n []Notifier
+		for i, w := range cfg.Notification.Webhooks {
+			n = append(n, only(w.Only, &webhook{name: fmt.Sprintf("webhooks[%d]", i), Webhook: w}))
+		}
+		return n
+	})
+}
+
+// webhook posts events as JSON to any URL
+type webhook struct {
+	// name refers to the webhook by its position, its URL may hold a token
+	name string
+	config.Webhook
+}
+
+func (w *webhook) Name() string {
+	return w.name
+}
+
+// webhookPayload is what webhooks receive
+type webhookPayload struct {
+	Event    Kind      `json:"event"`
+	Status   string    `json:"status"`
+	Project  string    `json:"project"`
+	Branch   string    `json:"branch"`
+	Commit   string    `json:"commit,omitempty"`
+	Author   string    `json:"author,omitempty"`
+	Target   string    `json:"target"`
+	Port     int       `json:"port,omitempty"`
+	Image    string    `json:"image,omitempty"`
+	URL      string    `json:"url,omitempty"`
+	Duration float64   `json:"duration_seconds,omitempty"`
+	Step     string    `json:"step,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+}
+
+func (w *webhook) Notify(e Event) error {
+	if utils.DryRun {
+		utils.PrintPlan(w.name, e.Text())
+		return nil
+	}
+
+	p := webhookPayload{
+		Event:    e.Kind,
+		Status:   e.Status(),
+		Project:  e.Project,
+		Branch:   e.Branch,
+		Commit:   e.SHA,
+		Author:   e.Author,
+		Target:   e.Target,
+		Port:     e.Port,
+		Image:    e.Image,
+		URL:      e.URL,
+		Duration: e.Duration.Seconds(),
+		Step:     e.Step,
+		Reason:   e.Reason,
+		Message:  e.Text(),
+		Time:     e.Time.UTC(),
+	}
+	if e.Err != nil {
+		p.Error = e.Err.Error()
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{}
+	for k, v := range w.Headers {
+		headers[k] = v
+	}
+	headers["Content-Type"] = "application/json"
+	headers[HeaderEvent] = string(e.Kind)
+	if w.Secret != "" {
+		headers[HeaderSignature] = Sign(w.Secret, body)
+	}
+	return utils.Post(w.URL, headers, body)
+}
+
+// Sign returns the signature of a webhook payload, receivers compute it
+// the same way with the shared secret and compare
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
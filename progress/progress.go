@@ -0,0 +1,284 @@
+// Package progress shows what every branch is doing on every target during a deploy:
+// a live table on terminals, prefixed lines otherwise
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Step is what is being done to a branch
+type Step string
+
+// Steps of a deploy, in order
+const (
+	Waiting  Step = "waiting"
+	Checkout Step = "checkout"
+	Build    Step = "build"
+	Push     Step = "push"
+	Pull     Step = "pull"
+	Run      Step = "run"
+	Health   Step = "health"
+	Notify   Step = "notify"
+)
+
+// spinner is drawn in front of rows still in progress
+var spinner = []string{"|", "/", "-", "\\"}
+
+type row struct {
+	target string
+	branch string
+	step   Step
+	start  time.Time
+	end    time.Time
+	done   bool
+	err    error
+}
+
+// elapsed returns how long the row has been worked on
+func (r *row) elapsed() time.Duration {
+	switch {
+	case r.start.IsZero():
+		return 0
+	case r.done:
+		return r.end.Sub(r.start)
+	}
+	return time.Since(r.start)
+}
+
+// Tracker follows the rows of a deploy, one per target and branch.
+// A nil Tracker does nothing, so code paths without progress need no checks.
+type Tracker struct {
+	mu    sync.Mutex
+	w     io.Writer
+	live  bool
+	rows  []*row
+	index map[string]*row
+	// lines is how many lines of the live table are on screen
+	lines int
+	frame int
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// New returns a tracker writing to w. Live trackers redraw a table in place
+// and need w to be a terminal.
+func New(w io.Writer, live bool) *Tracker {
+	return &Tracker{w: w, live: live, index: map[string]*row{}}
+}
+
+// IsTerminal reports whether f is a terminal, where a live table can be drawn
+func IsTerminal(f *os.File) bool {
+	return terminal.IsTerminal(int(f.Fd()))
+}
+
+func key(target, branch string) string {
+	return target + "\x00" + branch
+}
+
+// Add registers the row of the branch on the target, rows are shown in the order they are added
+func (t *Tracker) Add(target, branch string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.index[key(target, branch)]; ok {
+		return
+	}
+	r := &row{target: target, branch: branch, step: Waiting}
+	t.rows = append(t.rows, r)
+	t.index[key(target, branch)] = r
+}
+
+// Start draws the live table until Stop is called
+func (t *Tracker) Start() {
+	if t == nil || !t.live {
+		return
+	}
+	t.stop = make(chan struct{})
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		tick := time.NewTicker(100 * time.Millisecond)
+		defer tick.Stop()
+		for {
+			select {
+			case <-t.stop:
+				return
+			case <-tick.C:
+				t.mu.Lock()
+				t.frame++
+				t.render()
+				t.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// Step records that the branch moved on to step on the target
+func (t *Tracker) Step(target, branch string, step Step) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r, ok := t.index[key(target, branch)]
+	if !ok || r.done || r.step == step {
+		return
+	}
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
+	r.step = step
+	if !t.live {
+		fmt.Fprintf(t.w, "[%s %s] %s\n", target, branch, step)
+	}
+}
+
+// Finish records that the branch is deployed on the target, or failed to when err is not nil
+func (t *Tracker) Finish(target, branch string, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r, ok := t.index[key(target, branch)]
+	if !ok || r.done {
+		return
+	}
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
+	r.done, r.end, r.err = true, time.Now(), err
+	if !t.live {
+		fmt.Fprintf(t.w, "[%s %s] %s\n", target, branch, result(r))
+	}
+}
+
+// Stop stops drawing and prints the summary, rows never finished are reported as skipped
+func (t *Tracker) Stop() {
+	if t == nil {
+		return
+	}
+	if t.live && t.stop != nil {
+		close(t.stop)
+		t.wg.Wait()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.clear()
+	w := tabwriter.NewWriter(t.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tBRANCH\tRESULT\tDURATION")
+	for _, r := range t.rows {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.target, r.branch, result(r), r.elapsed().Round(time.Second))
+	}
+	w.Flush()
+}
+
+// LogWriter returns a writer for log entries which keeps them above the live table,
+// entries go straight to out when the tracker is not live
+func (t *Tracker) LogWriter(out io.Writer) io.Writer {
+	if t == nil || !t.live {
+		return out
+	}
+	return &logWriter{t: t, out: out}
+}
+
+type logWriter struct {
+	t   *Tracker
+	out io.Writer
+}
+
+// Fd returns the file descriptor of the output, loggers colour entries going to a terminal
+func (lw *logWriter) Fd() uintptr {
+	if f, ok := lw.out.(*os.File); ok {
+		return f.Fd()
+	}
+	return ^uintptr(0)
+}
+
+func (lw *logWriter) Write(p []byte) (int, error) {
+	lw.t.mu.Lock()
+	defer lw.t.mu.Unlock()
+
+	lw.t.clear()
+	n, err := lw.out.Write(p)
+	lw.t.render()
+	return n, err
+}
+
+// result describes how the row ended
+func result(r *row) string {
+	switch {
+	case !r.done:
+		return "skipped"
+	case r.err != nil:
+		return "failed: " + strings.SplitN(r.err.Error(), "\n", 2)[0]
+	}
+	return "deployed"
+}
+
+// clear removes the live table from the screen, the caller holds the lock
+func (t *Tracker) clear() {
+	if t.live && t.lines > 0 {
+		fmt.Fprintf(t.w, "\033[%dA\033[J", t.lines)
+		t.lines = 0
+	}
+}
+
+// render redraws the live table in place, the caller holds the lock
+func (t *Tracker) render() {
+	if !t.live {
+		return
+	}
+	width := 0
+	if f, ok := t.w.(*os.File); ok {
+		width, _, _ = terminal.GetSize(int(f.Fd()))
+	}
+
+	// Align the columns on the longest target and branch
+	tw, bw := 0, 0
+	for _, r := range t.rows {
+		if len(r.target) > tw {
+			tw = len(r.target)
+		}
+		if len(r.branch) > bw {
+			bw = len(r.branch)
+		}
+	}
+
+	if t.lines > 0 {
+		fmt.Fprintf(t.w, "\033[%dA", t.lines)
+	}
+	for _, r := range t.rows {
+		mark := spinner[t.frame%len(spinner)]
+		status := string(r.step)
+		switch {
+		case r.done && r.err != nil:
+			mark, status = "x", result(r)
+		case r.done:
+			mark, status = "✓", result(r)
+		case r.start.IsZero():
+			mark = " "
+		}
+		line := fmt.Sprintf("%s %-*s  %-*s  %-8s  %s", mark, tw, r.target, bw, r.branch, r.elapsed().Round(time.Second), status)
+		// Wrapped lines would break moving back up over the table
+		if width > 0 && len([]rune(line)) >= width {
+			line = string([]rune(line)[:width-1])
+		}
+		fmt.Fprintf(t.w, "\033[2K%s\n", line)
+	}
+	t.lines = len(t.rows)
+}
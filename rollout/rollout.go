@@ -0,0 +1,200 @@
+// Package rollout decides in which order, and how many at once, targets are worked on
+package rollout
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/dwarvesf/shot/config"
+)
+
+// Error is returned when the rollout stopped because of failing targets,
+// which are told by their address as several may be on the same host
+type Error struct {
+	Failed  map[string]error
+	Skipped []string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d target(s) failed, %d skipped", len(e.Failed), len(e.Skipped))
+}
+
+// Run calls fn for every target following the rollout strategy, with at most parallel
+// calls at the same time (no limit when parallel < 1). It stops at the first failure:
+// targets which have not been started yet are skipped.
+func Run(targets []config.Target, r config.Rollout, parallel int, fn func(config.Target) error) error {
+	if len(targets) == 0 {
+		return nil
+	}
+
+	var batches [][]config.Target
+	switch r.Strategy {
+	case config.RolloutOneByOne:
+		for _, t := range targets {
+			batches = append(batches, []config.Target{t})
+		}
+	case config.RolloutBatch:
+		size := r.BatchSize
+		if size < 1 {
+			size = 1
+		}
+		for i := 0; i < len(targets); i += size {
+			end := i + size
+			if end > len(targets) {
+				end = len(targets)
+			}
+			batches = append(batches, targets[i:end])
+		}
+	case config.RolloutCanary:
+		canary, rest := splitCanary(targets, r.Canary)
+		batches = [][]config.Target{{canary}}
+		if len(rest) != 0 {
+			batches = append(batches, rest)
+		}
+	default:
+		batches = [][]config.Target{targets}
+	}
+
+	res := &Error{Failed: map[string]error{}}
+	for i, batch := range batches {
+		runBatch(batch, parallel, fn, res)
+		if len(res.Failed) != 0 {
+			for _, b := range batches[i+1:] {
+				for _, t := range b {
+					res.Skipped = append(res.Skipped, t.Addr())
+				}
+			}
+			break
+		}
+	}
+
+	if len(res.Failed) != 0 {
+		return res
+	}
+	return nil
+}
+
+// runBatch runs fn for every target of the batch concurrently, targets waiting
+// for a free slot are skipped once one has failed
+func runBatch(batch []config.Target, parallel int, fn func(config.Target) error, res *Error) {
+	if parallel < 1 {
+		parallel = len(batch) + 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallel)
+	for _, e := range batch {
+		t := e
+		sem <- struct{}{}
+
+		mu.Lock()
+		failed := len(res.Failed) != 0
+		if failed {
+			res.Skipped = append(res.Skipped, t.Addr())
+		}
+		mu.Unlock()
+		if failed {
+			<-sem
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := fn(t); err != nil {
+				mu.Lock()
+				res.Failed[t.Addr()] = err
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// splitCanary returns the canary target, the first one unless given by host, and all the others
+func splitCanary(targets []config.Target, host string) (config.Target, []config.Target) {
+	idx := 0
+	for i, t := range targets {
+		if t.Host == host {
+			idx = i
+			break
+		}
+	}
+
+	rest := make([]config.Target, 0, len(targets)-1)
+	rest = append(rest, targets[:idx]...)
+	rest = append(rest, targets[idx+1:]...)
+	return targets[idx], rest
+}
+
+// Limit caps how many calls run at the same time, whichever targets and branches they are for.
+// A nil Limit has no cap.
+type Limit chan struct{}
+
+// NewLimit returns a limit of n calls at the same time, no limit when n < 1
+func NewLimit(n int) Limit {
+	if n < 1 {
+		return nil
+	}
+	return make(Limit, n)
+}
+
+func (l Limit) acquire() {
+	if l != nil {
+		l <- struct{}{}
+	}
+}
+
+func (l Limit) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+// Do calls fn once one of the calls taking a slot of the limit is done
+func (l Limit) Do(fn func() error) error {
+	l.acquire()
+	defer l.release()
+	return fn()
+}
+
+// Each calls fn for every item within limit, which may be shared with other calls of Each so
+// that it holds across all of them, and returns the first error. Items waiting for a free slot
+// are skipped once one has failed.
+func Each(items []string, limit Limit, fn func(string) error) error {
+	var mu sync.Mutex
+	var first error
+	var wg sync.WaitGroup
+	for _, v := range items {
+		item := v
+		limit.acquire()
+
+		mu.Lock()
+		failed := first != nil
+		mu.Unlock()
+		if failed {
+			limit.release()
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer limit.release()
+
+			if err := fn(item); err != nil {
+				mu.Lock()
+				if first == nil {
+					first = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return first
+}
@@ -0,0 +1,300 @@
+package rollout
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dwarvesf/shot/config"
+)
+
+func targets(addrs ...string) []config.Target {
+	var ts []config.Target
+	for _, a := range addrs {
+		t := config.Target{Host: a, Port: 22}
+		if a == "b2" {
+			// Same host as b on another port
+			t = config.Target{Host: "b", Port: 2222}
+		}
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+func TestSplitCanary(t *testing.T) {
+	tests := []struct {
+		host   string
+		canary string
+		rest   []string
+	}{
+		{"", "a", []string{"b", "c"}},
+		{"b", "b", []string{"a", "c"}},
+		{"c", "c", []string{"a", "b"}},
+		{"missing", "a", []string{"b", "c"}},
+	}
+	for _, tt := range tests {
+		canary, rest := splitCanary(targets("a", "b", "c"), tt.host)
+		var got []string
+		for _, r := range rest {
+			got = append(got, r.Host)
+		}
+		if canary.Host != tt.canary || !reflect.DeepEqual(got, tt.rest) {
+			t.Errorf("splitCanary(%q) = %s, %v, want %s, %v", tt.host, canary.Host, got, tt.canary, tt.rest)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		rollout config.Rollout
+		fail    string
+		called  []string
+		failed  []string
+		skipped []string
+	}{
+		{
+			name:   "all",
+			called: []string{"a:22", "b:22", "c:22", "d:22"},
+		},
+		{
+			name:    "one by one stops at the first failure",
+			rollout: config.Rollout{Strategy: config.RolloutOneByOne},
+			fail:    "b:22",
+			called:  []string{"a:22", "b:22"},
+			failed:  []string{"b:22"},
+			skipped: []string{"c:22", "d:22"},
+		},
+		{
+			name:    "batches skip the next ones",
+			rollout: config.Rollout{Strategy: config.RolloutBatch, BatchSize: 3},
+			fail:    "a:22",
+			called:  []string{"a:22"},
+			failed:  []string{"a:22"},
+			skipped: []string{"b:22", "c:22", "d:22"},
+		},
+		{
+			name:    "failure in the last batch",
+			rollout: config.Rollout{Strategy: config.RolloutBatch, BatchSize: 3},
+			fail:    "d:22",
+			called:  []string{"a:22", "b:22", "c:22", "d:22"},
+			failed:  []string{"d:22"},
+		},
+		{
+			name:    "canary first",
+			rollout: config.Rollout{Strategy: config.RolloutCanary, Canary: "c"},
+			called:  []string{"c:22", "a:22", "b:22", "d:22"},
+		},
+		{
+			name:    "failing canary",
+			rollout: config.Rollout{Strategy: config.RolloutCanary, Canary: "c"},
+			fail:    "c:22",
+			called:  []string{"c:22"},
+			failed:  []string{"c:22"},
+			skipped: []string{"a:22", "b:22", "d:22"},
+		},
+	}
+	for _, tt := range tests {
+		var called []string
+		// One at a time so that calls happen in order
+		err := Run(targets("a", "b", "c", "d"), tt.rollout, 1, func(t config.Target) error {
+			called = append(called, t.Addr())
+			if t.Addr() == tt.fail {
+				return errors.New("boom")
+			}
+			return nil
+		})
+
+		if !reflect.DeepEqual(called, tt.called) {
+			t.Errorf("%s: called %v, want %v", tt.name, called, tt.called)
+		}
+		if tt.failed == nil {
+			if err != nil {
+				t.Errorf("%s: Run() = %v, want nil", tt.name, err)
+			}
+			continue
+		}
+		rErr, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%s: Run() = %v, want an *Error", tt.name, err)
+			continue
+		}
+		if got := keys(rErr.Failed); !reflect.DeepEqual(got, tt.failed) {
+			t.Errorf("%s: failed %v, want %v", tt.name, got, tt.failed)
+		}
+		if !reflect.DeepEqual(rErr.Skipped, tt.skipped) {
+			t.Errorf("%s: skipped %v, want %v", tt.name, rErr.Skipped, tt.skipped)
+		}
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		targets  []string
+		parallel int
+		fail     []string
+		max      int
+		failed   []string
+		skipped  []string
+	}{
+		{
+			name:     "no limit",
+			targets:  []string{"a", "b", "c", "d"},
+			parallel: 0,
+			max:      4,
+		},
+		{
+			name:     "limited",
+			targets:  []string{"a", "b", "c", "d"},
+			parallel: 2,
+			max:      2,
+		},
+		{
+			name:     "targets on the same host fail apart",
+			targets:  []string{"a", "b", "b2"},
+			parallel: 0,
+			fail:     []string{"b:22", "b:2222"},
+			max:      3,
+			failed:   []string{"b:22", "b:2222"},
+		},
+		{
+			name:     "waiting targets are skipped after a failure",
+			targets:  []string{"a", "b", "c"},
+			parallel: 1,
+			fail:     []string{"a:22"},
+			max:      1,
+			failed:   []string{"a:22"},
+			skipped:  []string{"b:22", "c:22"},
+		},
+	}
+	for _, tt := range tests {
+		var mu sync.Mutex
+		running, max := 0, 0
+		res := &Error{Failed: map[string]error{}}
+		runBatch(targets(tt.targets...), tt.parallel, func(t config.Target) error {
+			mu.Lock()
+			running++
+			if running > max {
+				max = running
+			}
+			mu.Unlock()
+			// Give the others time to start
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+
+			for _, f := range tt.fail {
+				if t.Addr() == f {
+					return errors.New("boom")
+				}
+			}
+			return nil
+		}, res)
+
+		if max != tt.max {
+			t.Errorf("%s: %d calls at once, want %d", tt.name, max, tt.max)
+		}
+		if got := keys(res.Failed); !reflect.DeepEqual(got, tt.failed) {
+			t.Errorf("%s: failed %v, want %v", tt.name, got, tt.failed)
+		}
+		if !reflect.DeepEqual(res.Skipped, tt.skipped) {
+			t.Errorf("%s: skipped %v, want %v", tt.name, res.Skipped, tt.skipped)
+		}
+	}
+}
+
+func TestEach(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  Limit
+		fail   string
+		called []string
+		err    bool
+	}{
+		{
+			name:   "no limit",
+			called: []string{"a", "b", "c"},
+		},
+		{
+			name:   "limited",
+			limit:  NewLimit(1),
+			called: []string{"a", "b", "c"},
+		},
+		{
+			name:   "items waiting are skipped after a failure",
+			limit:  NewLimit(1),
+			fail:   "b",
+			called: []string{"a", "b"},
+			err:    true,
+		},
+	}
+	for _, tt := range tests {
+		var mu sync.Mutex
+		var called []string
+		err := Each([]string{"a", "b", "c"}, tt.limit, func(item string) error {
+			mu.Lock()
+			called = append(called, item)
+			mu.Unlock()
+			if item == tt.fail {
+				return errors.New("boom")
+			}
+			return nil
+		})
+
+		sort.Strings(called)
+		if !reflect.DeepEqual(called, tt.called) {
+			t.Errorf("%s: called %v, want %v", tt.name, called, tt.called)
+		}
+		if (err != nil) != tt.err {
+			t.Errorf("%s: Each() = %v, want an error %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestLimitShared(t *testing.T) {
+	// Two calls of Each on the same limit never go beyond it together
+	limit := NewLimit(2)
+	var mu sync.Mutex
+	running, max := 0, 0
+	fn := func(string) error {
+		mu.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Each([]string{"a", "b", "c"}, limit, fn)
+		}()
+	}
+	wg.Wait()
+
+	if max != 2 {
+		t.Errorf("%d calls at once, want 2", max)
+	}
+}
+
+func keys(m map[string]error) []string {
+	var ks []string
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
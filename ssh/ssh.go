@@ -3,17 +3,46 @@ package ssh
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dwarvesf/shot/dflog"
+	"github.com/dwarvesf/shot/utils"
 	"golang.org/x/crypto/ssh"
 )
 
 var l = dflog.New()
 
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// Mask registers values which must never appear in logs, e.g. secrets passed on command lines
+func Mask(values ...string) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, v := range values {
+		if v != "" {
+			secrets = append(secrets, v)
+		}
+	}
+}
+
+// mask hides registered secrets in s
+func mask(s string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, v := range secrets {
+		s = strings.Replace(s, v, "***", -1)
+	}
+	return s
+}
+
 // Credential ...
 type Credential struct {
 	User string
@@ -21,13 +50,15 @@ type Credential struct {
 	Port int
 }
 
+// executeCmd runs cmd on the host and returns its output, it fails when cmd exits with a non-zero status
 func executeCmd(cmd string, hostname string, port int, config *ssh.ClientConfig) (string, error) {
 	conn, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", hostname, port), config)
 	if err != nil {
 		return "", err
 	}
+	defer conn.Close()
 
-	session, _ := conn.NewSession()
+	session, err := conn.NewSession()
 	if err != nil {
 		return "", err
 	}
@@ -35,9 +66,9 @@ func executeCmd(cmd string, hostname string, port int, config *ssh.ClientConfig)
 
 	var stdoutBuf bytes.Buffer
 	session.Stdout = &stdoutBuf
-	_ = session.Run(cmd)
+	err = session.Run(cmd)
 
-	return stdoutBuf.String(), nil
+	return stdoutBuf.String(), err
 }
 
 // 2015-06-10 20:10:08.123456
@@ -85,32 +116,84 @@ func itoa(buf *[]byte, i int, wid int) {
 	*buf = append(*buf, b[bp:]...)
 }
 
-// Run executes shell commands or given host
+// Run executes shell commands on given host, it fails when they exit with a non-zero status
 func Run(command string, c Credential) (string, error) {
+	if utils.DryRun {
+		utils.PrintPlan(c.Host, mask(command))
+		return "", nil
+	}
+
 	config, err := ClientConfig(c)
 	if err != nil {
 		return "", err
 	}
 
 	// Attemp to write command to log file
-	logCmd := fmt.Sprintf(`echo %s: "%s" >> /var/log/shot.log`, getTime(), command)
+	logCmd := fmt.Sprintf(`echo %s: "%s" >> /var/log/shot.log`, getTime(), mask(command))
 	_, _ = executeCmd(logCmd, c.Host, c.Port, config)
 
-	// Exec commands and write its output to log file
-	l.Info(c.Host + ": " + command)
-	response, err := executeCmd(command+" 2>&1 | tee -a var/log/shot.log", c.Host, c.Port, config)
+	// Exec commands, their output is not piped anywhere so their exit status is kept
+	l.Debug(c.Host + ": " + mask(command))
+	response, err := executeCmd(command+" 2>&1", c.Host, c.Port, config)
+	if _, ok := err.(*ssh.ExitError); ok {
+		return response, fmt.Errorf("%v: %s", err, mask(strings.TrimSpace(response)))
+	}
 	if err != nil {
 		return "", err
 	}
 
 	// Print out response
 	if len(response) != 0 {
-		l.Info(fmt.Sprintf(c.Host + ": " + strings.TrimSpace(response)))
+		l.Debug(c.Host + ": " + mask(strings.TrimSpace(response)))
 	}
 
 	return response, nil
 }
 
+// RunWithInput executes command on given host like Run, with its stdin read from in
+func RunWithInput(command string, in io.Reader, c Credential) (string, error) {
+	if utils.DryRun {
+		utils.PrintPlan(c.Host, mask(command)+" < stdin")
+		return "", nil
+	}
+
+	config, err := ClientConfig(c)
+	if err != nil {
+		return "", err
+	}
+
+	// Attemp to write command to log file
+	logCmd := fmt.Sprintf(`echo %s: "%s" >> /var/log/shot.log`, getTime(), mask(command))
+	_, _ = executeCmd(logCmd, c.Host, c.Port, config)
+
+	l.Debug(c.Host + ": " + mask(command))
+	conn, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", c.Host, c.Port), config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	var out bytes.Buffer
+	session.Stdin = in
+	session.Stdout = &out
+	session.Stderr = &out
+	if err = session.Run(command); err != nil {
+		return out.String(), fmt.Errorf("%v: %s", err, mask(strings.TrimSpace(out.String())))
+	}
+
+	if out.Len() != 0 {
+		l.Debug(c.Host + ": " + mask(strings.TrimSpace(out.String())))
+	}
+
+	return out.String(), nil
+}
+
 // ClientConfig ...
 func ClientConfig(c Credential) (*ssh.ClientConfig, error) {
 	// Get SSH key
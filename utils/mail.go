@@ -0,0 +1,225 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/dwarvesf/shot/config"
+)
+
+// SendMail sends one email to all recipients through the SMTP server of the configuration.
+// The email has an HTML alternative to the text body when html is not empty.
+func SendMail(to []string, subject, text, html string, config *config.Config) error {
+	if DryRun {
+		PrintPlan("mail "+strings.Join(to, ", "), subject)
+		return nil
+	}
+
+	s := config.Notification.Email.SMTP
+	from := mail.Address{Name: s.FromName, Address: s.FromEmail}
+	if from.Address == "" {
+		from.Address = s.User
+	}
+
+	msg, err := message(from, to, subject, text, html, s.Domain)
+	if err != nil {
+		return err
+	}
+
+	c, err := dialSMTP(s)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err = c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, r := range to {
+		if err = c.Rcpt(r); err != nil {
+			return fmt.Errorf("%s: %v", r, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// dialSMTP connects to the server, secures the connection and authenticates as configured
+func dialSMTP(s config.SMTP) (*smtp.Client, error) {
+	addr := net.JoinHostPort(s.Host, fmt.Sprint(s.Port))
+	tlsConfig := &tls.Config{ServerName: s.Host}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+
+	var conn net.Conn
+	var err error
+	if s.TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if s.Domain != "" {
+		if err = c.Hello(s.Domain); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	// Like net/smtp, upgrade whenever the server offers it unless starttls is turned off
+	if !s.TLS && (s.StartTLS == nil || *s.StartTLS) {
+		ok, _ := c.Extension("STARTTLS")
+		if !ok && s.StartTLS != nil {
+			c.Close()
+			return nil, errors.New("server does not support STARTTLS")
+		}
+		if ok {
+			if err = c.StartTLS(tlsConfig); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+	}
+
+	var auth smtp.Auth
+	switch s.Authentication {
+	case "", config.AuthPlain:
+		auth = smtp.PlainAuth("", s.User, s.Pass, s.Host)
+	case config.AuthLogin:
+		auth = &loginAuth{user: s.User, pass: s.Pass, host: s.Host}
+	case config.AuthCRAMMD5:
+		auth = smtp.CRAMMD5Auth(s.User, s.Pass)
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			c.Close()
+			return nil, errors.New("server does not support authentication")
+		}
+		if err = c.Auth(auth); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// message renders the headers and the body of an email, domain is used for its Message-ID
+func message(from mail.Address, to []string, subject, text, html, domain string) ([]byte, error) {
+	if domain == "" {
+		domain = from.Address[strings.LastIndex(from.Address, "@")+1:]
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	header := func(k, v string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+	}
+	header("From", from.String())
+	header("To", strings.Join(to, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<%s@%s>", hex.EncodeToString(id), domain))
+	header("MIME-Version", "1.0")
+
+	if html == "" {
+		header("Content-Type", "text/plain; charset=UTF-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQP(&buf, text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&buf)
+	header("Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", mw.Boundary()))
+	buf.WriteString("\r\n")
+	// Clients show the last part they can display, the richest goes last
+	for _, p := range []struct{ contentType, body string }{{"text/plain", text}, {"text/html", html}} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType + "; charset=UTF-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = writeQP(w, p.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeQP writes s quoted-printable encoded with CRLF line endings
+func writeQP(w io.Writer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(strings.Replace(s, "\n", "\r\n", -1))); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// loginAuth implements the LOGIN mechanism, which net/smtp does not provide
+type loginAuth struct {
+	user, pass, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Like PLAIN, never send the password in clear over the network
+	if !server.TLS && a.host != "localhost" && a.host != "127.0.0.1" && a.host != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSuffix(string(fromServer), ":")) {
+	case "username":
+		return []byte(a.user), nil
+	case "password":
+		return []byte(a.pass), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge %q", fromServer)
+}
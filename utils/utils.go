@@ -4,73 +4,142 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
-	"net/smtp"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/dwarvesf/shot/config"
 	"github.com/dwarvesf/shot/dflog"
 )
 
 var l = dflog.New()
 
-// ExecCmd receives cmdLine as input and helps to run it in shell env
-func ExecCmd(cmdLine string) (string, error) {
-	c := strings.Split(cmdLine, " ")
-	var args []string
-	for i := 1; i < len(c); i++ {
-		args = append(args, c[i])
+// DryRun makes commands and notifications be printed instead of executed or sent
+var DryRun bool
+
+var planMu sync.Mutex
+
+// PrintPlan prints what would be done on where, this machine or a host, in dry-run mode
+func PrintPlan(where, what string) {
+	planMu.Lock()
+	defer planMu.Unlock()
+	fmt.Printf("[dry-run] %s: %s\n", where, what)
+}
+
+// Exec runs the named program with given arguments without going through a shell,
+// so arguments may contain spaces
+func Exec(name string, args ...string) (string, error) {
+	if DryRun {
+		PrintPlan("local", ShellJoin(append([]string{name}, args...)))
+		return "", nil
 	}
 
-	cmd := exec.Command(c[0], args...)
+	cmd := exec.Command(name, args...)
 	stdout, err := cmd.Output()
 	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) != 0 {
+			return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(ee.Stderr)))
+		}
 		return "", err
 	}
 
 	return string(stdout), err
 }
 
-// PostToSlack will help to send notification messages to Slack channel
-func PostToSlack(channel, text string) error {
-	mJSON, err := json.Marshal(map[string]interface{}{
-		"text": text,
-	})
-	if err != nil {
-		return err
+// ExecWithInput runs the named program with its stdin read from in
+func ExecWithInput(in io.Reader, name string, args ...string) (string, error) {
+	if DryRun {
+		PrintPlan("local", ShellJoin(append([]string{name}, args...))+" < stdin")
+		return "", nil
 	}
 
-	body := bytes.NewReader(mJSON)
-	req, err := http.NewRequest("POST", channel, body)
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = in
+	stdout, err := cmd.Output()
 	if err != nil {
-		return err
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) != 0 {
+			return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(ee.Stderr)))
+		}
+		return "", err
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	_, err = client.Do(req)
-	if err != nil {
+	return string(stdout), nil
+}
+
+// ExecStream runs the named program and copies its stdout to w
+func ExecStream(w io.Writer, name string, args ...string) error {
+	if DryRun {
+		PrintPlan("local", ShellJoin(append([]string{name}, args...))+" |")
+		return nil
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() != 0 {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+		}
 		return err
 	}
 
 	return nil
 }
 
-// SendMail will help to send an email to recepients
-func SendMail(to, subject, body string, config *config.Config) error {
-	msg := "From: " + config.Notification.Email.SMTP.User + "\n" +
-		"To: " + to + "\n" +
-		"Subject: " + subject + "\n\n" +
-		body
+// ShellQuote quotes s so a POSIX shell reads it as one word
+func ShellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, needsQuote) < 0 {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
 
-	err := smtp.SendMail(fmt.Sprintf("%s:%d", config.Notification.Email.SMTP.Host, config.Notification.Email.SMTP.Port),
-		smtp.PlainAuth("", config.Notification.Email.SMTP.User, config.Notification.Email.SMTP.Pass, config.Notification.Email.SMTP.Host),
-		config.Notification.Email.SMTP.User, []string{to}, []byte(msg))
+func needsQuote(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=@,+%", r))
+}
+
+// ShellJoin quotes and joins args into a command line for a POSIX shell
+func ShellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = ShellQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
 
+// PostJSON posts payload encoded as JSON to url, responses other than 2xx are errors
+func PostJSON(url string, payload interface{}) error {
+	mJSON, err := json.Marshal(payload)
 	if err != nil {
 		return err
 	}
+	return Post(url, map[string]string{"Content-Type": "application/json"}, mJSON)
+}
 
+// Post sends body to url with given headers, responses other than 2xx are errors
+func Post(url string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
 	return nil
 }